@@ -2,20 +2,32 @@ package main
 
 import (
 	"errors"
+	"fmt"
+	"net/http"
 	"net/url"
 	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/asdine/storm"
 	"github.com/urfave/cli"
+	bolt "go.etcd.io/bbolt"
 	"go.uber.org/zap"
 
+	"github.com/dracher/podcast_fetcher/fakeprovider"
 	"github.com/dracher/podcast_fetcher/platform"
 )
 
+const dbFile = "podcasts.db"
+
 var (
 	errURLEmpty = errors.New("url can't be empty")
 	logger      *zap.SugaredLogger
+	cfg         *platform.Config
 )
 
 func init() {
@@ -30,9 +42,98 @@ func parseURL(uri string) error {
 	return err
 }
 
+// openDB opens the database, waiting a second when another process holds it
+func openDB() (*storm.DB, error) {
+	return storm.Open(dbFile, storm.BoltOptions(0600, &bolt.Options{Timeout: time.Second}))
+}
+
+// parseHeaders turns "Name: value" flags into a map
+func parseHeaders(flags []string) (map[string]string, error) {
+	headers := map[string]string{}
+	for _, h := range flags {
+		kv := strings.SplitN(h, ":", 2)
+		if len(kv) != 2 || strings.TrimSpace(kv[0]) == "" {
+			return nil, fmt.Errorf("header %q isn't like \"Name: value\"", h)
+		}
+		headers[strings.TrimSpace(kv[0])] = strings.TrimSpace(kv[1])
+	}
+	return headers, nil
+}
+
+// downloadOptions are download settings of config overridden by flags of c
+func downloadOptions(c *cli.Context) platform.DownloadConfig {
+	opts := platform.DownloadConfig{
+		Concurrency:    cfg.Download.Concurrency,
+		BytesPerSecond: cfg.Download.BytesPerSecond,
+		// the configured policy is already the default of every feed
+		Policy: c.String("policy"),
+	}
+	if n := c.Int("concurrency"); n > 0 {
+		opts.Concurrency = n
+	}
+	return opts
+}
+
+// parseBytes reads sizes like 300, 512k or 2m
+func parseBytes(s string) (int64, error) {
+	unit := int64(1)
+	switch strings.ToLower(s[len(s)-1:]) {
+	case "k":
+		unit, s = 1024, s[:len(s)-1]
+	case "m":
+		unit, s = 1024*1024, s[:len(s)-1]
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("size %q isn't like 300, 512k or 2m", s)
+	}
+	return n * unit, nil
+}
+
+// produceFeeds makes feeds of ids with produce, every one of all when ids is empty
+func produceFeeds(ids, all []string, produce func(id string) error) error {
+	if len(ids) == 0 {
+		ids = all
+		sort.Strings(ids)
+	}
+	for _, id := range ids {
+		if err := produce(id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// exitCode gives each kind of provider failure its own exit status for scripts
+func exitCode(err error) int {
+	switch {
+	case errors.Is(err, platform.ErrNotFound):
+		return 3
+	case errors.Is(err, platform.ErrRateLimited):
+		return 4
+	case errors.Is(err, platform.ErrForbidden):
+		return 5
+	case errors.Is(err, platform.ErrPaidContent):
+		return 6
+	case errors.Is(err, platform.ErrSchemaChanged):
+		return 7
+	case errors.Is(err, platform.ErrSessionExpired):
+		return 8
+	case errors.Is(err, platform.ErrProvider):
+		return 2
+	}
+	return 1
+}
+
 func main() {
-	db, err := storm.Open("podcasts.db")
-	defer db.Close()
+	db, err := openDB()
+	if err != nil {
+		logger.Fatalw("can't open database, is another podcast_fetcher running here?", "error", err)
+	}
+	// serve closes it before running, it's closed once whichever way main ends
+	var closeOnce sync.Once
+	closeDB := func() { closeOnce.Do(func() { db.Close() }) }
+	defer closeDB()
 	conn := platform.NewDB(db, logger)
 
 	app := cli.NewApp()
@@ -43,6 +144,53 @@ func main() {
 	app.Author = "dracher"
 	app.Email = "dracher@gmail.com"
 
+	app.Flags = []cli.Flag{
+		cli.StringFlag{
+			Name:  "config",
+			Value: "podcast_fetcher.json",
+			Usage: "path of json config file, e.g. itunes owner and per feed settings",
+		},
+		cli.StringFlag{
+			Name:  "fake-provider",
+			Usage: "send provider api requests to a fake server instead, e.g.: http://localhost:8089",
+		},
+		cli.StringSliceFlag{
+			Name:  "user-agent",
+			Usage: "user agent of provider requests, rotated when given more than once",
+		},
+		cli.StringSliceFlag{
+			Name:  "header",
+			Usage: "extra header of provider requests, e.g.: \"Accept-Language: zh-CN\"",
+		},
+		cli.StringFlag{
+			Name:  "referer",
+			Usage: "referer of provider requests",
+		},
+		cli.StringFlag{
+			Name:  "proxy",
+			Usage: "http or socks5 proxy of provider requests, e.g.: socks5://127.0.0.1:1080",
+		},
+	}
+	app.Before = func(c *cli.Context) (err error) {
+		if base := c.String("fake-provider"); base != "" {
+			platform.ProviderTransport = fakeprovider.Redirect{Base: base}
+		}
+		cfg, err = platform.LoadConfig(c.String("config"))
+		if err != nil {
+			return
+		}
+		headers, err := parseHeaders(c.GlobalStringSlice("header"))
+		if err != nil {
+			return
+		}
+		return cfg.SetHTTPFlags(platform.HTTPConfig{
+			UserAgents: c.GlobalStringSlice("user-agent"),
+			Headers:    headers,
+			Referer:    c.GlobalString("referer"),
+			Proxy:      c.GlobalString("proxy"),
+		})
+	}
+
 	app.Commands = []cli.Command{
 		cli.Command{
 			Name:      "喜马拉雅",
@@ -53,16 +201,39 @@ func main() {
 					Name:  "url",
 					Usage: "e.g.: https://www.ximalaya.com/yingshi/213124/",
 				},
+				cli.BoolFlag{
+					Name:  "probe",
+					Usage: "ask media servers for real length and type of enclosures",
+				},
+				cli.BoolFlag{
+					Name:  "strict",
+					Usage: "report missing and unknown fields of provider responses",
+				},
 				cli.BoolFlag{
 					Name:  "all",
 					Usage: "wether fetcher all items, default only fetch latest",
 				},
+				cli.BoolFlag{
+					Name:  "download",
+					Usage: "download media into archive after fetching, according to download policy",
+				},
 			},
 			Before: func(c *cli.Context) error {
 				return parseURL(c.String("url"))
 			},
 			Action: func(c *cli.Context) error {
-				return platform.NewHimalaya(c.String("url"), c.Command.Name, logger, conn).Start()
+				h := platform.NewHimalaya(c.String("url"), c.Command.Name, logger, conn).
+					WithConfig(cfg).
+					FetchAll(c.Bool("all")).
+					Probe(c.Bool("probe")).
+					Strict(c.Bool("strict"))
+				if err := h.Start(); err != nil {
+					return err
+				}
+				if c.Bool("download") {
+					return platform.Download(h.Meta().ID, conn, cfg, downloadOptions(c), logger)
+				}
+				return nil
 			},
 		},
 		cli.Command{
@@ -74,22 +245,496 @@ func main() {
 					Name:  "url",
 					Usage: "e.g.: http://www.lizhi.fm/user/2554978980702743084",
 				},
+				cli.BoolFlag{
+					Name:  "probe",
+					Usage: "ask media servers for real length and type of enclosures",
+				},
+				cli.BoolFlag{
+					Name:  "strict",
+					Usage: "report missing and unknown fields of provider responses",
+				},
 				cli.BoolFlag{
 					Name:  "all",
 					Usage: "whether fetch all items, default only fetch latest",
 				},
+				cli.BoolFlag{
+					Name:  "download",
+					Usage: "download media into archive after fetching, according to download policy",
+				},
 			},
 			Before: func(c *cli.Context) error {
 				return parseURL(c.String("url"))
 			},
 			Action: func(c *cli.Context) error {
-				return platform.NewLitchi(c.String("url"), c.Command.Name, logger, conn).Start()
+				l := platform.NewLitchi(c.String("url"), c.Command.Name, logger, conn).
+					WithConfig(cfg).
+					FetchAll(c.Bool("all")).
+					Probe(c.Bool("probe")).
+					Strict(c.Bool("strict"))
+				if err := l.Start(); err != nil {
+					return err
+				}
+				if c.Bool("download") {
+					return platform.Download(l.Meta().ID, conn, cfg, downloadOptions(c), logger)
+				}
+				return nil
+			},
+		},
+		cli.Command{
+			Name:      "reparse",
+			Usage:     "rebuild podcast records and feed from archived responses, without network access",
+			ArgsUsage: "<podcast id>",
+			Action: func(c *cli.Context) error {
+				pid := c.Args().First()
+				if pid == "" {
+					return fmt.Errorf("podcast id is missing")
+				}
+				return platform.Reparse(pid, conn, cfg, logger)
+			},
+		},
+		cli.Command{
+			Name:  "dev",
+			Usage: "tools for developing providers",
+			Subcommands: []cli.Command{
+				cli.Command{
+					Name:      "record",
+					Usage:     "record a provider session into a cassette for contract checks",
+					ArgsUsage: "<cassette file>",
+					Flags: []cli.Flag{
+						cli.StringFlag{
+							Name:  "url",
+							Usage: "album url, e.g.: https://www.ximalaya.com/yingshi/213124/",
+						},
+						cli.StringFlag{
+							Name:  "provider",
+							Usage: "provider name saved in podcast meta, e.g.: 喜马拉雅",
+						},
+						cli.BoolFlag{
+							Name:  "all",
+							Usage: "record a full fetch, default only latest",
+						},
+					},
+					Before: func(c *cli.Context) error {
+						return parseURL(c.String("url"))
+					},
+					Action: func(c *cli.Context) error {
+						path := c.Args().First()
+						name := strings.TrimSuffix(filepath.Base(path), filepath.Ext(path))
+						cassette, err := platform.RecordCassette(name, c.String("url"), c.String("provider"), c.Bool("all"), cfg, logger)
+						if err != nil {
+							return err
+						}
+						return cassette.Save(path)
+					},
+				},
+				cli.Command{
+					Name:  "fake-server",
+					Usage: "serve ximalaya and lizhi apis from synthetic albums, ximalaya 1000, 1001 (serial), 1002 (paid) and lizhi 2000",
+					Flags: []cli.Flag{
+						cli.StringFlag{
+							Name:  "addr",
+							Value: "localhost:8089",
+							Usage: "listen address",
+						},
+						cli.DurationFlag{
+							Name:  "latency",
+							Usage: "added to every response, e.g.: 200ms",
+						},
+						cli.Float64Flag{
+							Name:  "error-rate",
+							Usage: "share of requests answered with 500, e.g.: 0.1",
+						},
+						cli.IntFlag{
+							Name:  "rate-limit",
+							Usage: "requests allowed per second, over it gets 429",
+						},
+						cli.IntFlag{
+							Name:  "page-size",
+							Usage: "tracks per page, default is what each provider uses",
+						},
+						cli.BoolFlag{
+							Name:  "lying-has-more",
+							Usage: "ximalaya says hasMore on the last page",
+						},
+						cli.BoolFlag{
+							Name:  "empty-last-page",
+							Usage: "an empty page follows the last one",
+						},
+						cli.DurationFlag{
+							Name:  "media-ttl",
+							Usage: "ximalaya media urls expire after it, e.g.: 10s",
+						},
+						cli.BoolFlag{
+							Name:  "media-referer",
+							Usage: "reject media requests without a provider referer",
+						},
+						cli.BoolFlag{
+							Name:  "require-sign",
+							Usage: "reject ximalaya requests without a valid xm-sign header",
+						},
+					},
+					Action: func(c *cli.Context) error {
+						server := fakeprovider.New(fakeprovider.Options{
+							Latency:       c.Duration("latency"),
+							ErrorRate:     c.Float64("error-rate"),
+							RateLimit:     c.Int("rate-limit"),
+							PageSize:      c.Int("page-size"),
+							LyingHasMore:  c.Bool("lying-has-more"),
+							EmptyLastPage: c.Bool("empty-last-page"),
+							RequireSign:   c.Bool("require-sign"),
+							MediaTTL:      c.Duration("media-ttl"),
+							MediaReferer:  c.Bool("media-referer"),
+							Seed:          time.Now().UnixNano(),
+						})
+						logger.Infow("fake provider listening", "addr", c.String("addr"))
+						return http.ListenAndServe(c.String("addr"), server)
+					},
+				},
+				cli.Command{
+					Name:      "contract",
+					Usage:     "replay cassettes offline and check providers follow the contract",
+					ArgsUsage: "<cassette dir>",
+					Action: func(c *cli.Context) error {
+						paths, err := filepath.Glob(filepath.Join(c.Args().First(), "*.json"))
+						if err != nil {
+							return err
+						}
+						failed := 0
+						for _, path := range paths {
+							cassette, err := platform.LoadCassette(path)
+							if err != nil {
+								return err
+							}
+							broken := platform.RunContract(cassette, logger)
+							for _, err := range broken {
+								fmt.Println("FAIL", err)
+							}
+							if len(broken) == 0 {
+								fmt.Println("ok  ", cassette.Name)
+							} else {
+								failed++
+							}
+						}
+						if failed > 0 {
+							return fmt.Errorf("%d of %d cassettes break the contract", failed, len(paths))
+						}
+						return nil
+					},
+				},
+				cli.Command{
+					Name:      "tags",
+					Usage:     "show tags of downloaded mp3 or m4a files",
+					ArgsUsage: "<file>...",
+					Action: func(c *cli.Context) error {
+						for _, path := range c.Args() {
+							t, err := platform.ReadTags(path)
+							if err != nil {
+								return err
+							}
+							fmt.Printf("%s\n%s\n\n", path, t)
+						}
+						return nil
+					},
+				},
+			},
+		},
+		cli.Command{
+			Name:      "history",
+			Usage:     "show latest fetch runs of a podcast, with response shape warnings",
+			ArgsUsage: "<podcast id>",
+			Flags: []cli.Flag{
+				cli.IntFlag{
+					Name:  "n",
+					Value: 10,
+					Usage: "how many runs to show",
+				},
+			},
+			Action: func(c *cli.Context) error {
+				runs, err := conn.FindRuns(c.Args().First(), c.Int("n"))
+				if err != nil {
+					return err
+				}
+				for _, run := range runs {
+					status := "ok"
+					if !run.Success {
+						status = "failed: " + run.Error
+					}
+					fmt.Printf("%s %s %d items in %s, %s\n", run.StartedAt.Format(time.RFC3339), run.Source, run.Items, run.Duration, status)
+					for _, w := range run.Warnings {
+						fmt.Printf("    warning: %s\n", w)
+					}
+				}
+				return nil
+			},
+		},
+		cli.Command{
+			Name:      "download",
+			Usage:     "download media of podcasts into archive, every podcast in database when no id is given",
+			ArgsUsage: "[podcast id...]",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "policy",
+					Usage: "all, none or latest:N, overrides download policy of feeds",
+				},
+				cli.IntFlag{
+					Name:  "concurrency",
+					Usage: "parallel downloads (default 2)",
+				},
+				cli.StringFlag{
+					Name:  "limit",
+					Usage: "bandwidth shared by all downloads in bytes per second, e.g.: 512k, 2m",
+				},
+			},
+			Action: func(c *cli.Context) error {
+				ids := c.Args()
+				if len(ids) == 0 {
+					metas, err := conn.FindPodcasts()
+					if err != nil {
+						return err
+					}
+					for _, meta := range metas {
+						ids = append(ids, meta.ID)
+					}
+				}
+				opts := downloadOptions(c)
+				if limit := c.String("limit"); limit != "" {
+					bps, err := parseBytes(limit)
+					if err != nil {
+						return err
+					}
+					opts.BytesPerSecond = bps
+				}
+				var last error
+				for _, id := range ids {
+					if err := platform.Download(id, conn, cfg, opts, logger); err != nil {
+						logger.Error(err)
+						last = err
+					}
+				}
+				return last
+			},
+		},
+		cli.Command{
+			Name:      "composite",
+			Usage:     "make composite feeds from stored podcasts, every one in config when no id is given",
+			ArgsUsage: "[composite id...]",
+			Action: func(c *cli.Context) error {
+				var all []string
+				for id := range cfg.Composites {
+					all = append(all, id)
+				}
+				return produceFeeds(c.Args(), all, func(id string) error {
+					return platform.ProduceCompositeFeed(id, conn, cfg, logger)
+				})
+			},
+		},
+		cli.Command{
+			Name:      "split",
+			Usage:     "make split feeds from stored podcasts, every one in config when no id is given",
+			ArgsUsage: "[split id...]",
+			Action: func(c *cli.Context) error {
+				var all []string
+				for id := range cfg.Splits {
+					all = append(all, id)
+				}
+				return produceFeeds(c.Args(), all, func(id string) error {
+					return platform.ProduceSplitFeed(id, conn, cfg, logger)
+				})
+			},
+		},
+		cli.Command{
+			Name:      "inbox",
+			Usage:     "make inbox feeds of newest episodes of every podcast, every one in config when no id is given",
+			ArgsUsage: "[inbox id...]",
+			Action: func(c *cli.Context) error {
+				var all []string
+				for id := range cfg.Inboxes {
+					all = append(all, id)
+				}
+				return produceFeeds(c.Args(), all, func(id string) error {
+					return platform.ProduceInboxFeed(id, conn, cfg, logger)
+				})
+			},
+		},
+		cli.Command{
+			Name:      "preview-filter",
+			Usage:     "show which items filters of a feed keep, filter flags try one instead of the config",
+			ArgsUsage: "<podcast id>",
+			Flags: []cli.Flag{
+				cli.StringFlag{Name: "title", Usage: "title regexp"},
+				cli.StringFlag{Name: "description", Usage: "description regexp"},
+				cli.StringFlag{Name: "min-duration", Usage: "e.g.: 10m"},
+				cli.StringFlag{Name: "max-duration", Usage: "e.g.: 90s"},
+				cli.StringFlag{Name: "after", Usage: "published on this day or later, e.g.: 2019-01-31"},
+				cli.StringFlag{Name: "before", Usage: "published before this day"},
+				cli.BoolFlag{Name: "exclude", Usage: "try the filter as an exclude filter"},
+			},
+			Action: func(c *cli.Context) error {
+				pid := c.Args().First()
+				if pid == "" {
+					return fmt.Errorf("podcast id is missing")
+				}
+				fc := cfg.Feed(pid)
+				f := platform.ItemFilter{
+					Title:       c.String("title"),
+					Description: c.String("description"),
+					MinDuration: c.String("min-duration"),
+					MaxDuration: c.String("max-duration"),
+					After:       c.String("after"),
+					Before:      c.String("before"),
+				}
+				if f != (platform.ItemFilter{}) {
+					fc.Include, fc.Exclude = nil, nil
+					if c.Bool("exclude") {
+						fc.Exclude = []platform.ItemFilter{f}
+					} else {
+						fc.Include = []platform.ItemFilter{f}
+					}
+				}
+				results, err := platform.PreviewFilter(pid, conn, fc)
+				if err != nil {
+					return err
+				}
+				kept := 0
+				for _, r := range results {
+					mark := "-"
+					if r.Kept {
+						mark = "+"
+						kept++
+					}
+					fmt.Printf("%s %s %6s %s", mark, r.Item.PubDate.Format("2006-01-02"), time.Duration(r.Item.Duration)*time.Second, r.Item.Title)
+					if r.Reason != "" {
+						fmt.Printf("  (%s)", r.Reason)
+					}
+					fmt.Println()
+				}
+				fmt.Printf("%d of %d items kept\n", kept, len(results))
+				return nil
+			},
+		},
+		cli.Command{
+			Name:      "prune",
+			Usage:     "delete items retention of their feed doesn't keep, every podcast in database when no id is given",
+			ArgsUsage: "[podcast id...]",
+			Flags: []cli.Flag{
+				cli.BoolFlag{
+					Name:  "dry-run",
+					Usage: "only report what would be deleted from database, feeds and archive",
+				},
+			},
+			Action: func(c *cli.Context) error {
+				ids := c.Args()
+				if len(ids) == 0 {
+					metas, err := conn.FindPodcasts()
+					if err != nil {
+						return err
+					}
+					for _, meta := range metas {
+						ids = append(ids, meta.ID)
+					}
+				}
+				verb := "deleted"
+				if c.Bool("dry-run") {
+					verb = "would delete"
+				}
+				for _, id := range ids {
+					report, err := platform.Prune(id, conn, cfg, c.Bool("dry-run"), logger)
+					if err != nil {
+						return err
+					}
+					fmt.Printf("%s (retention %s): %s %d items, %d files, %d archived responses, %d runs\n",
+						id, report.Rule, verb, len(report.Items), len(report.Files), report.Responses, report.Runs)
+					for _, item := range report.Items {
+						fmt.Printf("  item  %s %s %s\n", item.ID, item.PubDate.Format("2006-01-02"), item.Title)
+					}
+					for _, path := range report.Files {
+						fmt.Printf("  file  %s\n", path)
+					}
+					if report.InFeed > 0 {
+						fmt.Printf("  feed  %s loses %d entries\n", report.Feed, report.InFeed)
+					}
+				}
+				return nil
+			},
+		},
+		cli.Command{
+			Name:  "serve",
+			Usage: "serve generated feeds, archived media and the media proxy, set BaseURL to where it's reachable",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "addr",
+					Value: ":8080",
+					Usage: "listen address",
+				},
+			},
+			Action: func(c *cli.Context) error {
+				// feeds and media are files, don't keep the database locked for fetches
+				closeDB()
+				logger.Infow("serving feeds and media", "addr", c.String("addr"), "base", cfg.BaseURL)
+				server := platform.NewServer(cfg, logger).WithProxy(func() (*platform.DB, error) {
+					db, err := openDB()
+					if err != nil {
+						return nil, err
+					}
+					return platform.NewDB(db, logger), nil
+				})
+				return http.ListenAndServe(c.String("addr"), server)
+			},
+		},
+		cli.Command{
+			Name:  "session",
+			Usage: "manage logged in provider sessions used to fetch member content",
+			Subcommands: []cli.Command{
+				cli.Command{
+					Name:      "import",
+					Usage:     "import cookies of a provider from a netscape cookies.txt or a json export",
+					ArgsUsage: "<ximalaya|lizhi> <cookies file>",
+					Action: func(c *cli.Context) error {
+						session, err := platform.ImportSession(c.Args().Get(0), c.Args().Get(1), conn)
+						if err != nil {
+							return err
+						}
+						fmt.Printf("imported %d cookies of %s\n", len(session.Cookies), session.Source)
+						return nil
+					},
+				},
+				cli.Command{
+					Name:  "show",
+					Usage: "list stored sessions, cookie values are never shown",
+					Action: func(c *cli.Context) error {
+						sessions, err := conn.FindSessions()
+						if err != nil {
+							return err
+						}
+						for _, s := range sessions {
+							status := "ok"
+							if s.Expired {
+								status = "expired"
+							}
+							fmt.Printf("%s %s, imported %s, updated %s\n", s.Source, status, s.ImportedAt.Format(time.RFC3339), s.UpdatedAt.Format(time.RFC3339))
+							for _, cookie := range s.Cookies {
+								fmt.Printf("    %s\n", cookie)
+							}
+						}
+						return nil
+					},
+				},
+				cli.Command{
+					Name:      "clear",
+					Usage:     "forget stored session of a provider",
+					ArgsUsage: "<ximalaya|lizhi>",
+					Action: func(c *cli.Context) error {
+						return conn.DeleteSession(c.Args().First())
+					},
+				},
 			},
 		},
 	}
 
 	err = app.Run(os.Args)
 	if err != nil {
-		logger.Fatal(err)
+		logger.Error(err)
+		closeDB()
+		os.Exit(exitCode(err))
 	}
 }
@@ -8,7 +8,7 @@ require (
 	github.com/levigross/grequests v0.0.0-20181123014746-f3f67e7783bb
 	github.com/pkg/errors v0.8.0 // indirect
 	github.com/urfave/cli v1.20.0
-	go.etcd.io/bbolt v1.3.0 // indirect
+	go.etcd.io/bbolt v1.3.0
 	go.uber.org/atomic v1.3.2 // indirect
 	go.uber.org/multierr v1.1.0 // indirect
 	go.uber.org/zap v1.9.1
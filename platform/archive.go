@@ -0,0 +1,177 @@
+package platform
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// RawResponse is a provider response archived as is, so records can be rebuilt
+// after a parsing fix without asking providers again
+type RawResponse struct {
+	ID        int    `storm:"id,increment"`
+	URL       string `storm:"index"`
+	PodcastID string `storm:"index"`
+	Source    string
+	Status    int
+	Header    http.Header
+	FetchedAt time.Time
+	Body      []byte // gzip compressed
+}
+
+// archiveKept is how many responses of a url are kept, older ones are deleted
+const archiveKept = 3
+
+// archivedQueries are the album and track endpoints reparse needs, responses
+// of others like server time are never archived
+var archivedQueries = []string{
+	himalayaPodcastMetaQuery,
+	himalayaPodcastQuery,
+	himalayaItemQuery,
+	himalayaTrackAudioQuery,
+	himalayaTrackMediaQuery,
+	litchiPodcastMetaQuery,
+	litchiPodcastQuery,
+	litchiTrackInfoQuery,
+}
+
+// archived if responses of url are worth archiving
+func archived(url string) bool {
+	for _, query := range archivedQueries {
+		if strings.HasPrefix(url, query[:strings.Index(query, "%")]) {
+			return true
+		}
+	}
+	return false
+}
+
+// itemResponseURLs are urls of archived responses about item alone, they go
+// away with it when it's pruned
+func itemResponseURLs(meta PodcastMeta, item PodcastItem) []string {
+	switch meta.Source {
+	case himalayaSource:
+		id, err := strconv.Atoi(item.ID)
+		if err != nil {
+			return nil
+		}
+		return []string{
+			fmt.Sprintf(himalayaItemQuery, id),
+			fmt.Sprintf(himalayaTrackAudioQuery, id),
+			fmt.Sprintf(himalayaTrackMediaQuery, id),
+		}
+	case litchiSource:
+		return []string{fmt.Sprintf(litchiTrackInfoQuery, meta.Band, item.ID)}
+	}
+	return nil
+}
+
+// archiveTransport stores successful GET responses of album and track
+// endpoints passing through it, the latest archiveKept of each url
+type archiveTransport struct {
+	next      http.RoundTripper
+	db        *DB
+	source    string
+	podcastID string
+}
+
+func (t *archiveTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.next.RoundTrip(req)
+	url := req.URL.String()
+	if err != nil || req.Method != "GET" || resp.StatusCode != http.StatusOK || !archived(url) {
+		return resp, err
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	resp.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	zw.Write(body)
+	zw.Close()
+	t.db.SaveRawResponse(RawResponse{
+		URL:       url,
+		PodcastID: t.podcastID,
+		Source:    t.source,
+		Status:    resp.StatusCode,
+		Header:    redactHeader(resp.Header),
+		FetchedAt: time.Now(),
+		Body:      buf.Bytes(),
+	})
+	if err := t.db.TrimRawResponses(url, archiveKept); err != nil {
+		t.db.log.Warnw("can't delete old archived responses", "url", url, "error", err)
+	}
+	return resp, nil
+}
+
+// replayTransport answers requests with the latest successful archived response, never touches network
+type replayTransport struct {
+	db *DB
+}
+
+func (t replayTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	raw, err := t.db.FindRawResponse(req.URL.String())
+	if err != nil {
+		return nil, fmt.Errorf("%s isn't archived", req.URL)
+	}
+	zr, err := gzip.NewReader(bytes.NewReader(raw.Body))
+	if err != nil {
+		return nil, err
+	}
+	body, err := ioutil.ReadAll(zr)
+	if err != nil {
+		return nil, err
+	}
+	return &http.Response{
+		Status:        http.StatusText(raw.Status),
+		StatusCode:    raw.Status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        raw.Header,
+		Body:          ioutil.NopCloser(bytes.NewReader(body)),
+		ContentLength: int64(len(body)),
+		Request:       req,
+	}, nil
+}
+
+// ProviderTransport carries provider api requests, e.g. replaced to talk to a fakeprovider server
+var ProviderTransport http.RoundTripper = http.DefaultTransport
+
+// newArchivingClient is the http client providers use, responses go to the archive
+func newArchivingClient(db *DB, source, pid string) *http.Client {
+	client := &http.Client{
+		Transport: &archiveTransport{next: ProviderTransport, db: db, source: source, podcastID: pid},
+		Timeout:   time.Minute,
+	}
+	if jar := newSessionJar(db, source); jar != nil {
+		client.Jar = jar
+	}
+	return client
+}
+
+// Reparse rebuilds meta and items of podcast pid from archived responses
+func Reparse(pid string, db *DB, cfg *Config, log *zap.SugaredLogger) error {
+	meta, err := db.FindPodcastMeta(pid)
+	if err != nil {
+		return err
+	}
+	if meta.Source == "" {
+		// saved before Source existed
+		meta.Source = sourceOfURL(meta.Link)
+	}
+	f, err := newFetcher(meta, fetchOptions{offline: true}, db, cfg, log)
+	if err != nil {
+		return err
+	}
+	return f.Start()
+}
@@ -0,0 +1,59 @@
+package platform
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/dracher/podcast_fetcher/fakeprovider"
+)
+
+func TestArchiveTransport(t *testing.T) {
+	srv := httptest.NewServer(fakeprovider.New(fakeprovider.Options{}))
+	defer srv.Close()
+	db := newTestDB(t)
+	client := &http.Client{Transport: &archiveTransport{
+		next:      fakeprovider.Redirect{Base: srv.URL},
+		db:        db,
+		source:    himalayaSource,
+		podcastID: "1000",
+	}}
+	album := fmt.Sprintf(himalayaPodcastMetaQuery, "1000")
+	for i := 0; i < archiveKept+2; i++ {
+		for _, url := range []string{album, himalayaServerTimeQuery, fmt.Sprintf(himalayaPodcastMetaQuery, "404")} {
+			resp, err := client.Get(url)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+		}
+	}
+
+	var list []RawResponse
+	if err := db.db.Find("URL", album, &list); err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != archiveKept {
+		t.Errorf("%d responses of album archived, want %d", len(list), archiveKept)
+	}
+	if !db.HasRawResponse(album) {
+		t.Error("album isn't archived")
+	}
+	if db.HasRawResponse(himalayaServerTimeQuery) {
+		t.Error("server time is archived")
+	}
+
+	replay := &http.Client{Transport: replayTransport{db: db}}
+	resp, err := replay.Get(album)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("replayed album got status %d", resp.StatusCode)
+	}
+	if _, err := replay.Get(himalayaServerTimeQuery); err == nil {
+		t.Error("server time is replayed")
+	}
+}
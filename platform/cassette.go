@@ -0,0 +1,155 @@
+package platform
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sync"
+)
+
+// Interaction is one recorded http exchange
+type Interaction struct {
+	Method string
+	URL    string
+	Status int
+	Header http.Header
+	Body   string
+}
+
+// Cassette is a recorded session with a provider, together with what the
+// contract expects from replaying it. It's an http.RoundTripper which records
+// when created by NewRecorder and replays when loaded by LoadCassette
+type Cassette struct {
+	Name        string
+	Source      string
+	Provider    string
+	URL         string
+	FetchAll    bool
+	ExpectError string // kind of error the run must fail with, see ErrorKind
+
+	Interactions []Interaction
+
+	next   http.RoundTripper
+	mu     sync.Mutex
+	served map[string]int
+	misses []string
+}
+
+// NewRecorder records every exchange going through next
+func NewRecorder(next http.RoundTripper) *Cassette {
+	return &Cassette{next: next}
+}
+
+// LoadCassette reads a cassette for replay
+func LoadCassette(path string) (*Cassette, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	c := &Cassette{}
+	if err := json.Unmarshal(data, c); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return c, nil
+}
+
+// Save writes cassette to path
+func (c *Cassette) Save(path string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	data, err := json.MarshalIndent(c, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, data, 0644)
+}
+
+// RoundTrip is
+func (c *Cassette) RoundTrip(req *http.Request) (*http.Response, error) {
+	if c.next != nil {
+		return c.record(req)
+	}
+	return c.replay(req)
+}
+
+func (c *Cassette) record(req *http.Request) (*http.Response, error) {
+	resp, err := c.next.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	resp.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+	c.mu.Lock()
+	c.Interactions = append(c.Interactions, Interaction{
+		Method: req.Method,
+		URL:    req.URL.String(),
+		Status: resp.StatusCode,
+		Header: redactHeader(resp.Header),
+		Body:   string(body),
+	})
+	c.mu.Unlock()
+	return resp, nil
+}
+
+// replay serves interactions of the same method and url in recorded order,
+// the last one is repeated when asked more often than recorded
+func (c *Cassette) replay(req *http.Request) (*http.Response, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.served == nil {
+		c.served = map[string]int{}
+	}
+	key := req.Method + " " + req.URL.String()
+	var matched []Interaction
+	for _, i := range c.Interactions {
+		if i.Method == req.Method && i.URL == req.URL.String() {
+			matched = append(matched, i)
+		}
+	}
+	if len(matched) == 0 {
+		c.misses = append(c.misses, key)
+		return nil, fmt.Errorf("%s isn't in cassette %s", key, c.Name)
+	}
+	n := c.served[key]
+	c.served[key]++
+	if n >= len(matched) {
+		n = len(matched) - 1
+	}
+	i := matched[n]
+	return &http.Response{
+		Status:        http.StatusText(i.Status),
+		StatusCode:    i.Status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        i.Header,
+		Body:          ioutil.NopCloser(bytes.NewReader([]byte(i.Body))),
+		ContentLength: int64(len(i.Body)),
+		Request:       req,
+	}, nil
+}
+
+// Misses returns requests asked during replay which aren't recorded
+func (c *Cassette) Misses() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]string(nil), c.misses...)
+}
+
+// Served returns how many times each recorded request was asked during replay
+func (c *Cassette) Served() map[string]int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	ret := map[string]int{}
+	for k, v := range c.served {
+		ret[k] = v
+	}
+	return ret
+}
@@ -0,0 +1,318 @@
+package platform
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+	"unicode"
+
+	"go.uber.org/zap"
+)
+
+// CompositeConfig is a feed merging items of stored podcasts, e.g. a show
+// published on both ximalaya and lizhi, or a series split across albums.
+// Episodes found in several podcasts are merged, they are the same when their
+// normalized titles are equal and durations and dates are close enough
+type CompositeConfig struct {
+	// Podcasts are ids of stored podcasts, the first one gives what the feed
+	// is about unless Feeds overrides it, serial feeds go in this order
+	Podcasts []string
+	// Prefer is sources in order of preference for merged episodes, e.g.
+	// ["lizhi", "ximalaya"], after episodes which can be played and are archived
+	Prefer []string
+	// DurationTolerance and DateTolerance are how far apart durations and
+	// publish times of the same episode can be, default 1m and 72h
+	DurationTolerance string
+	DateTolerance     string
+}
+
+const (
+	defaultDurationTolerance = time.Minute
+	defaultDateTolerance     = 72 * time.Hour
+)
+
+func (c CompositeConfig) tolerances() (duration, date time.Duration, err error) {
+	duration, date = defaultDurationTolerance, defaultDateTolerance
+	if c.DurationTolerance != "" {
+		if duration, err = time.ParseDuration(c.DurationTolerance); err != nil {
+			return
+		}
+	}
+	if c.DateTolerance != "" {
+		date, err = time.ParseDuration(c.DateTolerance)
+	}
+	return
+}
+
+func (c CompositeConfig) validate() error {
+	if len(c.Podcasts) == 0 {
+		return fmt.Errorf("composite feed has no podcasts")
+	}
+	_, _, err := c.tolerances()
+	return err
+}
+
+// compositesOf returns ids of composite feeds having podcast pid
+func (c *Config) compositesOf(pid string) []string {
+	if c == nil {
+		return nil
+	}
+	var ids []string
+	for id, comp := range c.Composites {
+		for _, p := range comp.Podcasts {
+			if p == pid {
+				ids = append(ids, id)
+				break
+			}
+		}
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+var (
+	// bracketRe matches notes in brackets like 【每日更新】 or (上)
+	bracketRe = regexp.MustCompile(`【([^】]*)】|\[([^\]]*)\]|\(([^)]*)\)|（([^）]*)）`)
+	// marketingRe matches notes which only sell an episode, one copy has them
+	// and another doesn't. Others like (上) or (1/2) tell parts apart
+	marketingRe = regexp.MustCompile(`(?i)^(?:(?:每日更新|日更|独家|首发|最新|更新|热门|精选|推荐|免费|限免|会员|vip|付费|试听|原创|高清|已?完结|重磅|new|hot)[\s·|/、,，]*)+$`)
+	// episodeRe matches episode numbers, providers call them differently
+	episodeRe = regexp.MustCompile(`第\s*(\d+)\s*[集期回讲话]`)
+)
+
+// normalizeTitle is what is left of title to tell an episode from others:
+// marketing notes in brackets, spaces and punctuation are dropped, full width
+// characters are folded, letters lower cased and 第3集 is 第3期
+func normalizeTitle(title string) string {
+	title = episodeRe.ReplaceAllString(foldWidth(title), "第${1}期")
+	title = bracketRe.ReplaceAllStringFunc(title, func(note string) string {
+		inner := bracketRe.FindStringSubmatch(note)
+		for _, s := range inner[1:] {
+			if marketingRe.MatchString(strings.TrimSpace(s)) {
+				return ""
+			}
+		}
+		return note
+	})
+	var b strings.Builder
+	for _, r := range title {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			b.WriteRune(unicode.ToLower(r))
+		}
+	}
+	return b.String()
+}
+
+// foldWidth turns full width ascii like ＡＢ１ into AB1
+func foldWidth(s string) string {
+	return strings.Map(func(r rune) rune {
+		if r >= 0xff01 && r <= 0xff5e {
+			return r - 0xfee0
+		}
+		return r
+	}, s)
+}
+
+// episode is one episode of a composite feed, with every copy of it
+type episode struct {
+	copies []compositeItem
+}
+
+type compositeItem struct {
+	item   PodcastItem
+	source string
+	member int // position of its podcast in composite
+	key    string
+}
+
+func absDuration(d time.Duration) time.Duration {
+	if d < 0 {
+		return -d
+	}
+	return d
+}
+
+// same tells if a and b are copies of one episode
+func (a compositeItem) same(b compositeItem, duration, date time.Duration) bool {
+	if a.key == "" || a.key != b.key {
+		return false
+	}
+	if a.item.Duration != 0 && b.item.Duration != 0 &&
+		absDuration(time.Duration(a.item.Duration-b.item.Duration)*time.Second) > duration {
+		return false
+	}
+	return absDuration(a.item.PubDate.Sub(b.item.PubDate)) <= date
+}
+
+func maxBitrate(item PodcastItem) int {
+	best := 0
+	for _, v := range item.Variants {
+		if v.Bitrate > best {
+			best = v.Bitrate
+		}
+	}
+	return best
+}
+
+// better tells if a is a better copy of an episode than b: one which can be
+// played, then an archived one, then preferred source, then higher bitrate,
+// then the one of the earlier podcast of composite
+func (a compositeItem) better(b compositeItem, prefer []string) bool {
+	playable := func(c compositeItem) bool { return c.item.Src != "" && !c.item.Paid }
+	if playable(a) != playable(b) {
+		return playable(a)
+	}
+	if (a.item.LocalPath != "") != (b.item.LocalPath != "") {
+		return a.item.LocalPath != ""
+	}
+	rank := func(c compositeItem) int {
+		for i, s := range prefer {
+			if s == c.source {
+				return i
+			}
+		}
+		return len(prefer)
+	}
+	if rank(a) != rank(b) {
+		return rank(a) < rank(b)
+	}
+	if maxBitrate(a.item) != maxBitrate(b.item) {
+		return maxBitrate(a.item) > maxBitrate(b.item)
+	}
+	return a.member < b.member
+}
+
+// mergeEpisodes groups items of composite members into episodes, in member order
+func mergeEpisodes(members [][]compositeItem, duration, date time.Duration) []*episode {
+	var episodes []*episode
+	byKey := map[string][]*episode{}
+	for _, items := range members {
+		for _, c := range items {
+			var found *episode
+			for _, e := range byKey[c.key] {
+				if e.copies[0].same(c, duration, date) && !e.has(c.member) {
+					found = e
+					break
+				}
+			}
+			if found == nil {
+				found = &episode{}
+				episodes = append(episodes, found)
+				byKey[c.key] = append(byKey[c.key], found)
+			}
+			found.copies = append(found.copies, c)
+		}
+	}
+	return episodes
+}
+
+func (e *episode) has(member int) bool {
+	for _, c := range e.copies {
+		if c.member == member {
+			return true
+		}
+	}
+	return false
+}
+
+// storedPodcasts returns ids of every stored podcast
+func storedPodcasts(db *DB) (map[string]bool, error) {
+	metas, err := db.FindPodcasts()
+	if err != nil {
+		return nil, err
+	}
+	stored := map[string]bool{}
+	for _, meta := range metas {
+		stored[meta.ID] = true
+	}
+	return stored, nil
+}
+
+// derivedFeedGUID is podcast:guid of a feed made of stored podcasts, which has
+// no provider link of its own
+func derivedFeedGUID(id string, cfg *Config) string {
+	if url := cfg.FeedURL(id); url != "" {
+		return podcastGUID(url)
+	}
+	return podcastGUID("podcast_fetcher/" + id)
+}
+
+// ProduceCompositeFeed generates composite feed id from stored items of its
+// podcasts. Guid of a merged episode is the one of its copy in the earliest
+// podcast, so it doesn't change when another copy becomes the best one
+func ProduceCompositeFeed(id string, db *DB, cfg *Config, log *zap.SugaredLogger) error {
+	comp, ok := cfg.Composites[id]
+	if !ok {
+		return fmt.Errorf("no composite feed %s: %w", id, ErrNotFound)
+	}
+	duration, date, err := comp.tolerances()
+	if err != nil {
+		return err
+	}
+	stored, err := storedPodcasts(db)
+	if err != nil {
+		return err
+	}
+	if stored[id] {
+		return fmt.Errorf("composite feed %s has the id of a podcast, their feeds would overwrite each other", id)
+	}
+
+	var src feedSource
+	var members [][]compositeItem
+	for n, pid := range comp.Podcasts {
+		if !stored[pid] {
+			return fmt.Errorf("podcast %s of composite feed %s isn't stored: %w", pid, id, ErrNotFound)
+		}
+		meta, err := db.FindPodcastMeta(pid)
+		if err != nil {
+			return err
+		}
+		if meta.Source == "" {
+			meta.Source = sourceOfURL(meta.Link)
+		}
+		if n == 0 {
+			src.meta = meta
+		}
+		items, err := db.FindPodcastItems(pid)
+		if err != nil {
+			return err
+		}
+		// oldest first, so a serial composite plays album after album
+		sortItems(items, true)
+		var list []compositeItem
+		for _, item := range items {
+			list = append(list, compositeItem{
+				item:   item,
+				source: meta.Source,
+				member: n,
+				key:    normalizeTitle(item.Title),
+			})
+		}
+		members = append(members, list)
+	}
+
+	src.meta.ID = id
+	src.guid = derivedFeedGUID(id, cfg)
+	src.guids = map[string]string{}
+	episodes := mergeEpisodes(members, duration, date)
+	merged := 0
+	for n, e := range episodes {
+		best := e.copies[0]
+		for _, c := range e.copies[1:] {
+			if c.better(best, comp.Prefer) {
+				best = c
+			}
+		}
+		item := best.item
+		item.Index = n + 1
+		src.items = append(src.items, item)
+		first := e.copies[0]
+		src.guids[item.ID] = itemGUID(PodcastMeta{Source: first.source}, first.item)
+		merged += len(e.copies) - 1
+	}
+	log.Infow("making composite feed", "id", id, "podcasts", len(comp.Podcasts), "episodes", len(episodes), "merged", merged)
+	writeFeed(id, src, db, cfg, log)
+	return nil
+}
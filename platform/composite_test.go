@@ -0,0 +1,232 @@
+package platform
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dracher/podcast_fetcher/fakeprovider"
+	"go.uber.org/zap"
+)
+
+func TestNormalizeTitle(t *testing.T) {
+	cases := []struct {
+		a, b string
+		same bool
+	}{
+		{"每日新闻 第3集", "每日新闻 第3期", true},
+		{"每日新闻 第 3 回", "每日新闻第3讲", true},
+		{"【每日更新】每日新闻 第3期", "每日新闻 第3期", true},
+		{"每日新闻 第3期【独家首发】", "每日新闻：第3期", true},
+		{"[VIP] 每日新闻 第3期 (new)", "每日新闻 第3期", true},
+		{"ＡＢＣ 访谈 １", "abc访谈1", true},
+		{"三国演义(上)", "三国演义(下)", false},
+		{"三国演义（上）", "三国演义(上)", true},
+		{"三国演义(上)", "三国演义", false},
+		{"访谈 (1/2)", "访谈 (2/2)", false},
+		{"【第3期】每日新闻", "【第4期】每日新闻", false},
+		{"【第3集】每日新闻", "每日新闻 第3期", false},
+		{"【第3集】每日新闻", "[第3期] 每日新闻", true},
+		{"【嘉宾：主播甲】每日新闻", "每日新闻", false},
+	}
+	for _, c := range cases {
+		a, b := normalizeTitle(c.a), normalizeTitle(c.b)
+		if (a == b) != c.same {
+			t.Errorf("%q is %q, %q is %q, same %v, want %v", c.a, a, c.b, b, a == b, c.same)
+		}
+	}
+}
+
+// testCopy is a copy of an episode in member of a composite
+func testCopy(member int, source, title string, duration int, date time.Time) compositeItem {
+	return compositeItem{
+		item:   PodcastItem{ID: fmt.Sprintf("%d-%s", member, title), Title: title, Duration: duration, PubDate: date},
+		source: source,
+		member: member,
+		key:    normalizeTitle(title),
+	}
+}
+
+func TestMergeEpisodes(t *testing.T) {
+	day := 24 * time.Hour
+	cases := []struct {
+		name     string
+		members  [][]compositeItem
+		episodes []int // copies of each episode
+	}{
+		{"across sources", [][]compositeItem{
+			{testCopy(0, "ximalaya", "新闻 第1集", 600, testTime), testCopy(0, "ximalaya", "新闻 第2集", 600, testTime.Add(day))},
+			{testCopy(1, "lizhi", "新闻 第1期", 630, testTime.Add(time.Hour)), testCopy(1, "lizhi", "新闻 第2期", 600, testTime.Add(2*day))},
+		}, []int{2, 2}},
+		{"part markers", [][]compositeItem{
+			{testCopy(0, "ximalaya", "三国(上)", 600, testTime), testCopy(0, "ximalaya", "三国(下)", 600, testTime)},
+			{testCopy(1, "lizhi", "三国（下）", 600, testTime)},
+		}, []int{1, 2}},
+		{"duration too far", [][]compositeItem{
+			{testCopy(0, "ximalaya", "新闻 第1集", 600, testTime)},
+			{testCopy(1, "lizhi", "新闻 第1期", 661, testTime)},
+		}, []int{1, 1}},
+		{"unknown duration", [][]compositeItem{
+			{testCopy(0, "ximalaya", "新闻 第1集", 0, testTime)},
+			{testCopy(1, "lizhi", "新闻 第1期", 600, testTime)},
+		}, []int{2}},
+		{"date too far", [][]compositeItem{
+			{testCopy(0, "ximalaya", "新闻 第1集", 600, testTime)},
+			{testCopy(1, "lizhi", "新闻 第1期", 600, testTime.Add(73*time.Hour))},
+		}, []int{1, 1}},
+		{"reruns in one podcast", [][]compositeItem{
+			{testCopy(0, "ximalaya", "新闻 第1集", 600, testTime), testCopy(0, "ximalaya", "新闻 第1集", 600, testTime.Add(time.Hour))},
+			{testCopy(1, "lizhi", "新闻 第1期", 600, testTime)},
+		}, []int{2, 1}},
+	}
+	for _, c := range cases {
+		episodes := mergeEpisodes(c.members, defaultDurationTolerance, defaultDateTolerance)
+		var got []int
+		for _, e := range episodes {
+			got = append(got, len(e.copies))
+		}
+		if fmt.Sprint(got) != fmt.Sprint(c.episodes) {
+			t.Errorf("%s: copies of episodes %v, want %v", c.name, got, c.episodes)
+		}
+	}
+}
+
+func TestCompositeTolerances(t *testing.T) {
+	cases := []struct {
+		duration, date string
+		wantDuration   time.Duration
+		wantDate       time.Duration
+		err            bool
+	}{
+		{"", "", time.Minute, 72 * time.Hour, false},
+		{"5m", "", 5 * time.Minute, 72 * time.Hour, false},
+		{"", "1h", time.Minute, time.Hour, false},
+		{"a minute", "", 0, 0, true},
+		{"", "3d", 0, 0, true},
+	}
+	for _, c := range cases {
+		comp := CompositeConfig{Podcasts: []string{"1000"}, DurationTolerance: c.duration, DateTolerance: c.date}
+		duration, date, err := comp.tolerances()
+		if (err != nil) != c.err || (comp.validate() != nil) != c.err {
+			t.Errorf("%q, %q: error %v, want error %v", c.duration, c.date, err, c.err)
+			continue
+		}
+		if !c.err && (duration != c.wantDuration || date != c.wantDate) {
+			t.Errorf("%q, %q: tolerances %v, %v, want %v, %v", c.duration, c.date, duration, date, c.wantDuration, c.wantDate)
+		}
+	}
+
+	// a looser tolerance merges what the default doesn't
+	members := [][]compositeItem{
+		{testCopy(0, "ximalaya", "新闻 第1集", 600, testTime)},
+		{testCopy(1, "lizhi", "新闻 第1期", 900, testTime.Add(96*time.Hour))},
+	}
+	if got := mergeEpisodes(members, 5*time.Minute, 100*time.Hour); len(got) != 1 {
+		t.Errorf("%d episodes with loose tolerances, want 1", len(got))
+	}
+}
+
+func TestCompositeBetter(t *testing.T) {
+	base := func(member int, source string) compositeItem {
+		c := testCopy(member, source, "新闻 第1集", 600, testTime)
+		c.item.Src = "https://media.example.com/" + source + ".mp3"
+		return c
+	}
+	with := func(c compositeItem, f func(*PodcastItem)) compositeItem {
+		f(&c.item)
+		return c
+	}
+	bitrate := func(kbps int) func(*PodcastItem) {
+		return func(item *PodcastItem) { item.Variants = []MediaVariant{{URL: item.Src, Bitrate: kbps}} }
+	}
+	cases := []struct {
+		name   string
+		a, b   compositeItem
+		prefer []string
+	}{
+		{"playable over paid", base(1, "lizhi"), with(base(0, "ximalaya"), func(item *PodcastItem) { item.Paid = true }), []string{"ximalaya"}},
+		{"playable over no media", base(1, "lizhi"), with(base(0, "ximalaya"), func(item *PodcastItem) { item.Src = "" }), nil},
+		{"archived over preferred", with(base(1, "lizhi"), func(item *PodcastItem) { item.LocalPath = "lizhi/2001/a.mp3" }), base(0, "ximalaya"), []string{"ximalaya"}},
+		{"preferred over bitrate", with(base(1, "lizhi"), bitrate(32)), with(base(0, "ximalaya"), bitrate(64)), []string{"lizhi", "ximalaya"}},
+		{"listed over unlisted", base(1, "lizhi"), base(0, "ximalaya"), []string{"lizhi"}},
+		{"bitrate", with(base(1, "lizhi"), bitrate(64)), with(base(0, "ximalaya"), bitrate(32)), nil},
+		{"earlier member", base(0, "ximalaya"), base(1, "ximalaya"), nil},
+	}
+	for _, c := range cases {
+		if !c.a.better(c.b, c.prefer) {
+			t.Errorf("%s: a isn't better", c.name)
+		}
+		if c.b.better(c.a, c.prefer) {
+			t.Errorf("%s: b is better too", c.name)
+		}
+	}
+}
+
+// compositeFeed is items of a feed with their guids
+type compositeFeed struct {
+	Channel struct {
+		Items []struct {
+			Title string `xml:"title"`
+			GUID  string `xml:"guid"`
+		} `xml:"item"`
+	} `xml:"channel"`
+}
+
+func TestProduceCompositeFeed(t *testing.T) {
+	fakeProvider(t, fakeprovider.New(fakeprovider.Options{}))
+	log := zap.NewNop().Sugar()
+	db := newTestDB(t)
+	cfg := &Config{FeedDir: t.TempDir(), Composites: map[string]CompositeConfig{}}
+	// 1000 has 75 tracks on ximalaya, 2001 the first 30 of them on lizhi
+	if err := NewHimalaya("https://www.ximalaya.com/yingshi/1000/", "喜马拉雅", log, db).WithConfig(cfg).FetchAll(true).Start(); err != nil {
+		t.Fatal(err)
+	}
+	if err := NewLitchi("http://www.lizhi.fm/user/2001", "荔枝FM", log, db).WithConfig(cfg).FetchAll(true).Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, prefer := range []string{"lizhi", "ximalaya"} {
+		cfg.Composites["news"] = CompositeConfig{Podcasts: []string{"1000", "2001"}, Prefer: []string{prefer}}
+		if err := ProduceCompositeFeed("news", db, cfg, log); err != nil {
+			t.Fatal(err)
+		}
+		data, err := ioutil.ReadFile(cfg.FeedPath("news"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var feed compositeFeed
+		if err := xml.Unmarshal(data, &feed); err != nil {
+			t.Fatal(err)
+		}
+		if len(feed.Channel.Items) != 75 {
+			t.Fatalf("prefer %s: %d episodes, want 75", prefer, len(feed.Channel.Items))
+		}
+		for _, item := range feed.Channel.Items {
+			var n int
+			fmt.Sscanf(item.Title[strings.Index(item.Title, "第"):], "第%d", &n)
+			copy := "集"
+			if prefer == "lizhi" && n <= 30 {
+				copy = "期"
+			}
+			if want := fmt.Sprintf("每日新闻 第%d%s", n, copy); item.Title != want {
+				t.Errorf("prefer %s: episode %d is %q, want %q", prefer, n, item.Title, want)
+			}
+			// the copy of the first podcast gives the guid, whichever goes in the feed
+			if want := fmt.Sprintf("ximalaya-1000-%d", 10000000+n); item.GUID != want {
+				t.Errorf("prefer %s: guid of episode %d is %s, want %s", prefer, n, item.GUID, want)
+			}
+		}
+	}
+
+	cfg.Composites["1000"] = CompositeConfig{Podcasts: []string{"2001"}}
+	if err := ProduceCompositeFeed("1000", db, cfg, log); err == nil {
+		t.Error("composite feed with the id of a podcast is written")
+	}
+	cfg.Composites["missing"] = CompositeConfig{Podcasts: []string{"1000", "9999"}}
+	if err := ProduceCompositeFeed("missing", db, cfg, log); err == nil {
+		t.Error("composite feed of a podcast which isn't stored is written")
+	}
+}
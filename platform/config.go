@@ -0,0 +1,221 @@
+package platform
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Config is loaded from a json file, every field is optional
+type Config struct {
+	BaseURL string // where generated feeds are served, e.g.: https://example.com/feeds
+	FeedDir string // where generated feeds are written, default current dir
+	// ArchiveDir is where media is downloaded, default archive
+	ArchiveDir string
+	Download   DownloadConfig
+	Proxy      ProxyConfig
+	Owner      Owner
+	Explicit   bool
+	// Locked asks other platforms not to import feeds, by podcast:locked
+	// with the email of the owner, feeds without one are never locked
+	Locked bool
+	Feeds  map[string]FeedConfig // keyed by podcast id
+
+	// Retention is the retention of feeds without their own, serial ones keep everything
+	Retention string
+	// Composites are feeds merging several podcasts keyed by their own id,
+	// which is also their key in Feeds
+	Composites map[string]CompositeConfig
+	// Splits are feeds made of part of one podcast keyed by their own id,
+	// which is also their key in Feeds
+	Splits map[string]SplitConfig
+	// Inboxes are feeds of newest episodes of every podcast keyed by their
+	// own id, which is also their key in Feeds
+	Inboxes map[string]InboxConfig
+
+	HTTP      HTTPConfig
+	Providers map[string]HTTPConfig // keyed by source, ximalaya or lizhi
+
+	flags HTTPConfig // from command line, beats everything
+}
+
+// Owner is the itunes:owner of generated feeds
+type Owner struct {
+	Name  string
+	Email string
+}
+
+// FeedConfig is per feed settings, zero values fall back to global ones
+type FeedConfig struct {
+	Owner    Owner
+	Author   string
+	Explicit *bool
+	Locked   *bool
+	Type     string // itunes:type, episodic or serial
+
+	// Title, Description, Category, Cover and Language override what provider
+	// says, Category is an itunes category with an optional subcategory, e.g.
+	// Arts/Books, Cover is an image url and Language like zh-cn
+	Title       string
+	Description string
+	Category    string
+	Cover       string
+	Language    string
+	// TitleRewrites are applied to titles of items in order
+	TitleRewrites []TitleRewrite
+	// Tags put the podcast in collections, inbox feeds can keep only some
+	Tags []string
+
+	// Quality is preferred variants of enclosure in order, each one a quality,
+	// a format or format:quality, e.g. ["m4a:64k", "high", "mp3"]
+	Quality []string
+	// AlternateEnclosures also lists other variants as podcast:alternateEnclosure
+	AlternateEnclosures bool
+	// Paid is what to do with paid items: skip (default), marker or sample
+	Paid string
+
+	HTTP HTTPConfig
+	// Download is which items to keep in archive: none (default), all or latest:N
+	Download string
+	// LocalEnclosures points enclosures of archived items to the built-in server at BaseURL
+	LocalEnclosures bool
+	// ProxyEnclosures points other enclosures to the media proxy of the built-in server
+	ProxyEnclosures bool
+	// Retention is which items to keep in database, feed and archive after each
+	// update: all (default), last:N or days:D
+	Retention string
+	// Include and Exclude filter items when the feed is generated, an item is
+	// kept when it matches any include filter, or there is none, and no exclude one
+	Include []ItemFilter
+	Exclude []ItemFilter
+}
+
+// LoadConfig reads config from path, a missing file gives an empty config
+func LoadConfig(path string) (*Config, error) {
+	cfg := &Config{}
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return cfg, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, cfg); err != nil {
+		return nil, err
+	}
+	if err := cfg.HTTP.validate(); err != nil {
+		return nil, err
+	}
+	for source, h := range cfg.Providers {
+		if err := h.validate(); err != nil {
+			return nil, fmt.Errorf("%s: %v", source, err)
+		}
+	}
+	if _, err := downloadLimit(cfg.Download.Policy); err != nil {
+		return nil, err
+	}
+	if _, _, err := parseRetention(cfg.Retention); err != nil {
+		return nil, err
+	}
+	for id, comp := range cfg.Composites {
+		if err := comp.validate(); err != nil {
+			return nil, fmt.Errorf("composite feed %s: %v", id, err)
+		}
+	}
+	for id, split := range cfg.Splits {
+		if _, err := split.compile(); err != nil {
+			return nil, fmt.Errorf("split feed %s: %v", id, err)
+		}
+	}
+	for id, inbox := range cfg.Inboxes {
+		if err := inbox.validate(); err != nil {
+			return nil, fmt.Errorf("inbox feed %s: %v", id, err)
+		}
+	}
+	for pid, f := range cfg.Feeds {
+		if err := f.HTTP.validate(); err != nil {
+			return nil, fmt.Errorf("feed %s: %v", pid, err)
+		}
+		if _, err := downloadLimit(f.Download); err != nil {
+			return nil, fmt.Errorf("feed %s: %v", pid, err)
+		}
+		if _, _, err := parseRetention(f.Retention); err != nil {
+			return nil, fmt.Errorf("feed %s: %v", pid, err)
+		}
+		if _, err := compileFilters(f); err != nil {
+			return nil, fmt.Errorf("feed %s: %v", pid, err)
+		}
+		if _, err := compileRewrites(f.TitleRewrites); err != nil {
+			return nil, fmt.Errorf("feed %s: %v", pid, err)
+		}
+	}
+	return cfg, nil
+}
+
+// SetHTTPFlags overrides http identity of every provider and feed, e.g. by cli flags
+func (c *Config) SetHTTPFlags(h HTTPConfig) error {
+	if err := h.validate(); err != nil {
+		return err
+	}
+	c.flags = h
+	return nil
+}
+
+// Identity returns http identity used fetching podcast pid of source, global
+// settings are overridden by provider ones, then feed ones, then cli flags
+func (c *Config) Identity(source, pid string) HTTPConfig {
+	if c == nil {
+		return HTTPConfig{}
+	}
+	return c.HTTP.merge(c.Providers[source]).merge(c.Feeds[pid].HTTP).merge(c.flags)
+}
+
+// FeedURL returns public url of feed pid, empty when BaseURL isn't set
+func (c *Config) FeedURL(pid string) string {
+	if c == nil || c.BaseURL == "" {
+		return ""
+	}
+	return fmt.Sprintf("%s/%s.xml", strings.TrimRight(c.BaseURL, "/"), pid)
+}
+
+// FeedPath returns file path of feed pid
+func (c *Config) FeedPath(pid string) string {
+	dir := ""
+	if c != nil {
+		dir = c.FeedDir
+	}
+	return filepath.Join(dir, pid+".xml")
+}
+
+// ArchivePath returns dir where media is downloaded
+func (c *Config) ArchivePath() string {
+	if c == nil || c.ArchiveDir == "" {
+		return "archive"
+	}
+	return c.ArchiveDir
+}
+
+// Feed returns settings of podcast pid merged with global ones, safe on nil config
+func (c *Config) Feed(pid string) FeedConfig {
+	if c == nil {
+		return FeedConfig{}
+	}
+	f := c.Feeds[pid]
+	if f.Owner.Name == "" && f.Owner.Email == "" {
+		f.Owner = c.Owner
+	}
+	if f.Explicit == nil {
+		explicit := c.Explicit
+		f.Explicit = &explicit
+	}
+	if f.Locked == nil {
+		locked := c.Locked
+		f.Locked = &locked
+	}
+	if f.Download == "" {
+		f.Download = c.Download.Policy
+	}
+	return f
+}
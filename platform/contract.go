@@ -0,0 +1,240 @@
+package platform
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/asdine/storm"
+	"go.uber.org/zap"
+)
+
+// scratch is a throwaway db and feed dir, so recording and contract runs never touch real data
+type scratch struct {
+	dir string
+	db  *DB
+	cfg *Config
+}
+
+// newScratch makes a scratch keeping http identity of cfg, which may be nil
+func newScratch(cfg *Config, log *zap.SugaredLogger) (*scratch, error) {
+	dir, err := ioutil.TempDir("", "podcast_fetcher")
+	if err != nil {
+		return nil, err
+	}
+	sdb, err := storm.Open(filepath.Join(dir, "podcasts.db"))
+	if err != nil {
+		os.RemoveAll(dir)
+		return nil, err
+	}
+	s := &scratch{dir: dir, db: NewDB(sdb, log), cfg: &Config{FeedDir: dir}}
+	if cfg != nil {
+		s.cfg.HTTP, s.cfg.Providers, s.cfg.flags = cfg.HTTP, cfg.Providers, cfg.flags
+		s.cfg.Feeds = map[string]FeedConfig{}
+		for pid, f := range cfg.Feeds {
+			s.cfg.Feeds[pid] = FeedConfig{HTTP: f.HTTP}
+		}
+	}
+	return s, nil
+}
+
+func (s *scratch) close() {
+	s.db.db.Close()
+	os.RemoveAll(s.dir)
+}
+
+// fetcher builds provider of cassette, latest mode needs the podcast known to db
+// otherwise providers switch to a full fetch
+func (s *scratch) fetcher(c *Cassette, transport *Cassette, log *zap.SugaredLogger) (Fetcher, PodcastMeta, error) {
+	meta := PodcastMeta{Source: c.Source, Provider: c.Provider, Link: c.URL, ID: extractIDFromURL(c.URL)}
+	if !c.FetchAll {
+		if err := s.db.db.Save(&meta); err != nil {
+			return nil, meta, err
+		}
+	}
+	f, err := newFetcher(meta, fetchOptions{fetchAll: c.FetchAll, transport: transport}, s.db, s.cfg, log)
+	return f, meta, err
+}
+
+// RecordCassette fetches url from network and records every exchange, going
+// through ProviderTransport and the proxy of cfg like fetching does
+func RecordCassette(name, url, provider string, fetchAll bool, cfg *Config, log *zap.SugaredLogger) (*Cassette, error) {
+	s, err := newScratch(cfg, log)
+	if err != nil {
+		return nil, err
+	}
+	defer s.close()
+
+	source := sourceOfURL(url)
+	identity := newHTTPIdentity(s.cfg.Identity(source, extractIDFromURL(url)))
+	c := NewRecorder(identity.transport(ProviderTransport))
+	c.Name, c.Source, c.Provider, c.URL, c.FetchAll = name, source, provider, url, fetchAll
+	f, _, err := s.fetcher(c, c, log)
+	if err != nil {
+		return nil, err
+	}
+	c.ExpectError = ErrorKind(f.Start())
+	return c, nil
+}
+
+// contract feed, only what the contract checks
+type contractFeed struct {
+	Channel struct {
+		Title string `xml:"title"`
+		Items []struct {
+			GUID      string `xml:"guid"`
+			Enclosure struct {
+				URL string `xml:"url,attr"`
+			} `xml:"enclosure"`
+		} `xml:"item"`
+	} `xml:"channel"`
+}
+
+// RunContract replays cassette against its provider offline and returns every
+// broken rule: meta parsing, paging termination, latest vs full mode, error
+// envelopes and feed output
+func RunContract(c *Cassette, log *zap.SugaredLogger) []error {
+	s, err := newScratch(nil, log)
+	if err != nil {
+		return []error{err}
+	}
+	defer s.close()
+
+	f, meta, err := s.fetcher(c, c, log)
+	if err != nil {
+		return []error{err}
+	}
+	var broken []error
+	fail := func(format string, args ...interface{}) {
+		broken = append(broken, fmt.Errorf("%s: %s", c.Name, fmt.Sprintf(format, args...)))
+	}
+
+	runErr := f.Start()
+	for _, miss := range c.Misses() {
+		fail("asked a request not in cassette, paging doesn't stop where it did when recorded: %s", miss)
+	}
+	recorded := map[string]int{}
+	for _, i := range c.Interactions {
+		recorded[i.Method+" "+i.URL]++
+	}
+	for key, n := range c.Served() {
+		if n > recorded[key] {
+			fail("asked %d times but recorded %d times, paging loops: %s", n, recorded[key], key)
+		}
+	}
+
+	// error envelopes
+	if kind := ErrorKind(runErr); kind != c.ExpectError {
+		fail("run error is %q, expected %q: %v", kind, c.ExpectError, runErr)
+	}
+	if c.ExpectError != "" {
+		return broken
+	}
+
+	// meta parsing
+	stored, err := s.db.FindPodcastMeta(meta.ID)
+	if err != nil {
+		fail("meta isn't saved: %v", err)
+		return broken
+	}
+	if stored.Title == "" || stored.CoverImgURL == "" || stored.Source != c.Source {
+		fail("meta isn't parsed, title %q cover %q source %q", stored.Title, stored.CoverImgURL, stored.Source)
+	}
+
+	items, _ := s.db.FindPodcastItems(meta.ID)
+	if len(items) == 0 {
+		fail("no items fetched")
+	}
+	for _, item := range items {
+		// paid items may have no audio at all
+		if item.ID == "" || item.Title == "" || (item.Src == "" && !item.Paid) {
+			fail("item isn't parsed: %+v", item)
+		}
+	}
+
+	// latest vs full
+	if c.FetchAll {
+		broken = append(broken, checkLatest(c, items, log)...)
+	}
+
+	// feed output
+	data, err := ioutil.ReadFile(s.cfg.FeedPath(meta.ID))
+	if err != nil {
+		fail("feed isn't written: %v", err)
+		return broken
+	}
+	var feed contractFeed
+	if err := xml.Unmarshal(data, &feed); err != nil {
+		fail("feed isn't valid xml: %v", err)
+		return broken
+	}
+	if feed.Channel.Title != stored.Title {
+		fail("feed title %q, expected %q", feed.Channel.Title, stored.Title)
+	}
+	// paid items are left out or kept by the paid policy of feed
+	kept := applyPaidPolicy(items, s.cfg.Feed(meta.ID).Paid)
+	if len(feed.Channel.Items) != len(kept) {
+		fail("feed has %d items, db has %d kept by paid policy", len(feed.Channel.Items), len(kept))
+	}
+	guids := map[string]bool{}
+	for _, item := range feed.Channel.Items {
+		if item.GUID == "" || guids[item.GUID] {
+			fail("feed item guid %q is empty or duplicated", item.GUID)
+		}
+		guids[item.GUID] = true
+		if item.Enclosure.URL == "" {
+			fail("feed item %s has no enclosure", item.GUID)
+		}
+	}
+	return broken
+}
+
+// checkLatest replays full cassette c in latest mode, which must fetch the
+// newest items of the full fetch and nothing else
+func checkLatest(c *Cassette, full []PodcastItem, log *zap.SugaredLogger) []error {
+	latest := &Cassette{
+		Name:         c.Name + " (latest)",
+		Source:       c.Source,
+		Provider:     c.Provider,
+		URL:          c.URL,
+		Interactions: c.Interactions,
+	}
+	s, err := newScratch(nil, log)
+	if err != nil {
+		return []error{err}
+	}
+	defer s.close()
+	var broken []error
+	fail := func(format string, args ...interface{}) {
+		broken = append(broken, fmt.Errorf("%s: %s", latest.Name, fmt.Sprintf(format, args...)))
+	}
+
+	f, meta, err := s.fetcher(latest, latest, log)
+	if err != nil {
+		return []error{err}
+	}
+	if err := f.Start(); err != nil {
+		fail("run failed: %v", err)
+		return broken
+	}
+	for _, miss := range latest.Misses() {
+		fail("asked a request a full fetch doesn't: %s", miss)
+	}
+	items, _ := s.db.FindPodcastItems(meta.ID)
+	if len(items) == 0 || len(items) > len(full) {
+		fail("fetched %d items, full fetch has %d", len(items), len(full))
+		return broken
+	}
+	// both newest first, latest must be the head of full
+	sortItems(items, false)
+	sortItems(full, false)
+	for n, item := range items {
+		want := full[n]
+		if item.ID != want.ID || item.Title != want.Title || item.Index != want.Index || item.Src != want.Src {
+			fail("item %d is %s %q #%d, full fetch has %s %q #%d", n, item.ID, item.Title, item.Index, want.ID, want.Title, want.Index)
+		}
+	}
+	return broken
+}
@@ -1,7 +1,10 @@
 package platform
 
 import (
+	"sort"
+
 	"github.com/asdine/storm"
+	"github.com/asdine/storm/q"
 	"go.uber.org/zap"
 )
 
@@ -19,6 +22,11 @@ func NewDB(db *storm.DB, log *zap.SugaredLogger) *DB {
 	}
 }
 
+// Close is
+func (d DB) Close() error {
+	return d.db.Close()
+}
+
 // SaveMetaData is
 func (d DB) SaveMetaData(meta IPodcastMeta) error {
 	data := meta.Meta()
@@ -30,9 +38,18 @@ func (d DB) SaveMetaData(meta IPodcastMeta) error {
 	return nil
 }
 
-// SaveItems is
+// SaveItems is, download records of items already stored are kept and items
+// retention pruned aren't stored again
 func (d DB) SaveItems(data IPodcastItems) error {
 	for _, item := range data.Items() {
+		var pruned PrunedItem
+		if d.db.One("ID", item.ID, &pruned) == nil {
+			continue
+		}
+		var old PodcastItem
+		if item.LocalPath == "" && d.db.One("ID", item.ID, &old) == nil {
+			item.LocalPath, item.Checksum, item.DownloadedAt = old.LocalPath, old.Checksum, old.DownloadedAt
+		}
 		err := d.db.Save(&item)
 		if err != nil {
 			d.log.Error(err)
@@ -42,6 +59,46 @@ func (d DB) SaveItems(data IPodcastItems) error {
 	return nil
 }
 
+// SaveItem is
+func (d DB) SaveItem(item PodcastItem) error {
+	err := d.db.Save(&item)
+	if err != nil {
+		d.log.Error(err)
+		return err
+	}
+	return nil
+}
+
+// DeleteItem is
+func (d DB) DeleteItem(item PodcastItem) error {
+	return d.db.DeleteStruct(&item)
+}
+
+// SavePrunedItem is
+func (d DB) SavePrunedItem(p PrunedItem) error {
+	return d.db.Save(&p)
+}
+
+// ForgetPrunedItems deletes marks of items of podcast pid pruned by a rule other than rule
+func (d DB) ForgetPrunedItems(pid, rule string) error {
+	var list []PrunedItem
+	err := d.db.Find("PodcastID", pid, &list)
+	if err == storm.ErrNotFound {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	for _, p := range list {
+		if p.Rule == rule {
+			continue
+		}
+		if err := d.db.DeleteStruct(&p); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 // FindPodcastMeta is
 func (d DB) FindPodcastMeta(pid string) (PodcastMeta, error) {
 	var meta PodcastMeta
@@ -52,8 +109,186 @@ func (d DB) FindPodcastMeta(pid string) (PodcastMeta, error) {
 	return meta, nil
 }
 
+// FindPodcasts returns meta of every podcast
+func (d DB) FindPodcasts() (metas []PodcastMeta, err error) {
+	err = d.db.All(&metas)
+	return
+}
+
+// FindPodcastItem is
+func (d DB) FindPodcastItem(id string) (PodcastItem, error) {
+	var item PodcastItem
+	err := d.db.One("ID", id, &item)
+	return item, err
+}
+
 // FindPodcastItems is
 func (d DB) FindPodcastItems(pid string) (items []PodcastItem, err error) {
 	d.db.Find("AlbumID", pid, &items)
 	return
 }
+
+// FindMediaProbe is
+func (d DB) FindMediaProbe(url string) (MediaProbe, error) {
+	var probe MediaProbe
+	err := d.db.One("URL", url, &probe)
+	return probe, err
+}
+
+// SaveMediaProbe is
+func (d DB) SaveMediaProbe(probe MediaProbe) error {
+	err := d.db.Save(&probe)
+	if err != nil {
+		d.log.Error(err)
+		return err
+	}
+	return nil
+}
+
+// DeleteMediaProbe is
+func (d DB) DeleteMediaProbe(url string) error {
+	return d.db.DeleteStruct(&MediaProbe{URL: url})
+}
+
+// SaveRun is
+func (d DB) SaveRun(run RunRecord) error {
+	err := d.db.Save(&run)
+	if err != nil {
+		d.log.Error(err)
+		return err
+	}
+	return nil
+}
+
+// FindRuns returns latest runs of podcast pid, newest first
+func (d DB) FindRuns(pid string, limit int) (runs []RunRecord, err error) {
+	err = d.db.Select(q.Eq("PodcastID", pid)).OrderBy("ID").Reverse().Limit(limit).Find(&runs)
+	if err == storm.ErrNotFound {
+		err = nil
+	}
+	return
+}
+
+// FindOldRuns returns runs of podcast pid past the newest keep ones
+func (d DB) FindOldRuns(pid string, keep int) (runs []RunRecord, err error) {
+	err = d.db.Select(q.Eq("PodcastID", pid)).OrderBy("ID").Reverse().Skip(keep).Find(&runs)
+	if err == storm.ErrNotFound {
+		err = nil
+	}
+	return
+}
+
+// DeleteRun is
+func (d DB) DeleteRun(run RunRecord) error {
+	return d.db.DeleteStruct(&run)
+}
+
+// FindEndpointShapes returns shapes saved under baseline keyed by endpoint
+func (d DB) FindEndpointShapes(baseline string) (map[string]EndpointShape, error) {
+	var shapes []EndpointShape
+	err := d.db.Prefix("Key", baseline, &shapes)
+	if err != nil && err != storm.ErrNotFound {
+		return nil, err
+	}
+	ret := map[string]EndpointShape{}
+	for _, s := range shapes {
+		ret[s.Endpoint] = s
+	}
+	return ret, nil
+}
+
+// SaveEndpointShapes is
+func (d DB) SaveEndpointShapes(shapes []EndpointShape) error {
+	for _, shape := range shapes {
+		if err := d.db.Save(&shape); err != nil {
+			d.log.Error(err)
+			return err
+		}
+	}
+	return nil
+}
+
+// SaveRawResponse is
+func (d DB) SaveRawResponse(raw RawResponse) error {
+	err := d.db.Save(&raw)
+	if err != nil {
+		d.log.Error(err)
+		return err
+	}
+	return nil
+}
+
+// FindRawResponse returns latest archived 200 response of url
+func (d DB) FindRawResponse(url string) (RawResponse, error) {
+	var list []RawResponse
+	if err := d.db.Find("URL", url, &list); err != nil {
+		return RawResponse{}, err
+	}
+	var latest RawResponse
+	for _, raw := range list {
+		if raw.Status == 200 && raw.FetchedAt.After(latest.FetchedAt) {
+			latest = raw
+		}
+	}
+	if latest.ID == 0 {
+		return latest, storm.ErrNotFound
+	}
+	return latest, nil
+}
+
+// HasRawResponse if a response of url is archived, only successful ones are
+func (d DB) HasRawResponse(url string) bool {
+	var raw RawResponse
+	return d.db.One("URL", url, &raw) == nil
+}
+
+// CountRawResponses is how many responses of url are archived
+func (d DB) CountRawResponses(url string) (int, error) {
+	return d.db.Select(q.Eq("URL", url)).Count(&RawResponse{})
+}
+
+// TrimRawResponses deletes archived responses of url but the latest keep ones
+func (d DB) TrimRawResponses(url string, keep int) error {
+	var list []RawResponse
+	err := d.db.Find("URL", url, &list)
+	if err == storm.ErrNotFound {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].ID > list[j].ID })
+	for i := keep; i < len(list); i++ {
+		if err := d.db.DeleteStruct(&list[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// FindSession is
+func (d DB) FindSession(source string) (Session, error) {
+	var s Session
+	err := d.db.One("Source", source, &s)
+	return s, err
+}
+
+// SaveSession is
+func (d DB) SaveSession(s Session) error {
+	err := d.db.Save(&s)
+	if err != nil {
+		d.log.Error(err)
+		return err
+	}
+	return nil
+}
+
+// DeleteSession is
+func (d DB) DeleteSession(source string) error {
+	return d.db.DeleteStruct(&Session{Source: source})
+}
+
+// FindSessions is
+func (d DB) FindSessions() (sessions []Session, err error) {
+	err = d.db.All(&sessions)
+	return
+}
@@ -0,0 +1,366 @@
+package platform
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	"go.uber.org/zap"
+)
+
+// download policies of a feed, set by FeedConfig.Download
+const (
+	DownloadNone   = "none" // the default
+	DownloadAll    = "all"
+	DownloadLatest = "latest" // latest:N keeps newest N items
+)
+
+// DownloadConfig is
+type DownloadConfig struct {
+	Concurrency    int   // parallel downloads, default 2
+	BytesPerSecond int64 // shared by all downloads, 0 is unlimited
+	Policy         string
+}
+
+// downloadLimit parses a policy, -1 is every item, 0 none, otherwise newest n
+func downloadLimit(policy string) (int, error) {
+	switch policy {
+	case "", DownloadNone:
+		return 0, nil
+	case DownloadAll:
+		return -1, nil
+	}
+	if strings.HasPrefix(policy, DownloadLatest+":") {
+		n, err := strconv.Atoi(strings.TrimPrefix(policy, DownloadLatest+":"))
+		if err == nil && n > 0 {
+			return n, nil
+		}
+	}
+	return 0, fmt.Errorf("download policy %q isn't all, none or latest:N", policy)
+}
+
+// ArchivePath returns where item is kept in archive dir, relative to it:
+// <source>/<album id>/<date>-<title>-<track id>.<ext>, the id keeps episodes
+// of the same title and day apart
+func ArchivePath(source string, item PodcastItem, v MediaVariant) string {
+	name := fmt.Sprintf("%s-%s-%s.%s", item.PubDate.Format("2006-01-02"), safeFileName(item.Title), item.ID, v.ext())
+	return filepath.Join(source, item.AlbumID, name)
+}
+
+// safeFileName drops characters file systems don't like, and keeps it short
+func safeFileName(s string) string {
+	s = strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) || strings.ContainsRune(`/\:*?"<>|`, r) {
+			return '_'
+		}
+		return r
+	}, strings.TrimSpace(s))
+	if r := []rune(s); len(r) > 80 {
+		s = string(r[:80])
+	}
+	if s == "" {
+		s = "untitled"
+	}
+	return s
+}
+
+// rateLimiter keeps the average throughput of all downloads under rate bytes per second
+type rateLimiter struct {
+	rate int64
+
+	mu    sync.Mutex
+	start time.Time
+	sent  int64
+}
+
+func (l *rateLimiter) wait(n int) {
+	if l == nil || l.rate <= 0 {
+		return
+	}
+	l.mu.Lock()
+	now := time.Now()
+	if l.start.IsZero() || now.Sub(l.start) > time.Duration(l.sent*int64(time.Second)/l.rate)+time.Second {
+		// idle for a while, don't let it burst
+		l.start, l.sent = now, 0
+	}
+	l.sent += int64(n)
+	due := l.start.Add(time.Duration(l.sent * int64(time.Second) / l.rate))
+	l.mu.Unlock()
+	time.Sleep(time.Until(due))
+}
+
+type limitedReader struct {
+	r       io.Reader
+	limiter *rateLimiter
+}
+
+func (r limitedReader) Read(p []byte) (int, error) {
+	if len(p) > 32*1024 {
+		p = p[:32*1024]
+	}
+	n, err := r.r.Read(p)
+	r.limiter.wait(n)
+	return n, err
+}
+
+// mediaStatusError is an unexpected status of a media url
+type mediaStatusError struct {
+	url    string
+	status int
+}
+
+func (e *mediaStatusError) Error() string {
+	return fmt.Sprintf("download %s: status %d", e.url, e.status)
+}
+
+// downloader fetches media of items into an archive dir
+type downloader struct {
+	source   string
+	client   *http.Client
+	identity *httpIdentity
+	limiter  *rateLimiter
+	log      *zap.SugaredLogger
+
+	coverMu sync.Mutex
+	covers  map[string]Tags // cover art by url, fetched once per run
+}
+
+// fetch downloads url into path, a .part file left by an interrupted download
+// is resumed with a ranged request
+func (d *downloader) fetch(url, path string) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	part := path + ".part"
+	var offset int64
+	if fi, err := os.Stat(part); err == nil {
+		offset = fi.Size()
+	}
+
+	req, err := d.identity.mediaRequest(context.Background(), "GET", url, d.source)
+	if err != nil {
+		return err
+	}
+	if offset > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	}
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	flags := os.O_WRONLY | os.O_CREATE
+	switch {
+	case resp.StatusCode == http.StatusPartialContent && offset > 0:
+		d.log.Debugw("resuming download", "url", url, "offset", offset)
+		flags |= os.O_APPEND
+	case resp.StatusCode == http.StatusRequestedRangeNotSatisfiable && offset > 0:
+		// .part is complete already
+		flags = -1
+	case resp.StatusCode == http.StatusOK:
+		flags |= os.O_TRUNC
+	default:
+		return &mediaStatusError{url: url, status: resp.StatusCode}
+	}
+	if flags != -1 {
+		fp, err := os.OpenFile(part, flags, 0644)
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(fp, limitedReader{r: resp.Body, limiter: d.limiter})
+		if cerr := fp.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	return os.Rename(part, path)
+}
+
+// tag writes tags of item into the file at path, with metadata overrides of
+// fc, a failure only costs the tags
+func (d *downloader) tag(path string, meta PodcastMeta, item PodcastItem, fc FeedConfig) {
+	if items, err := overrideItems([]PodcastItem{item}, fc); err == nil {
+		item = items[0]
+	}
+	meta = overrideMeta(meta, fc)
+	t := itemTags(meta, item)
+	urls := []string{item.ImageURL, meta.CoverImgURL}
+	if fc.Cover != "" {
+		// low-res covers of provider are why it's overridden
+		urls = []string{fc.Cover}
+	}
+	d.coverMu.Lock()
+	cover, ok := d.covers[strings.Join(urls, " ")]
+	if !ok {
+		var err error
+		if cover.Cover, cover.CoverMime, err = fetchCover(urls, d.identity, d.source); err != nil {
+			d.log.Warnw("no cover art", "title", item.Title, "error", err)
+		}
+		d.covers[strings.Join(urls, " ")] = cover
+	}
+	d.coverMu.Unlock()
+	t.Cover, t.CoverMime = cover.Cover, cover.CoverMime
+	if err := WriteTags(path, t); err != nil {
+		d.log.Warnw("writing tags failed", "title", item.Title, "error", err)
+	}
+}
+
+func fileChecksum(path string) (string, error) {
+	fp, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer fp.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, fp); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// itemsToDownload returns items policy keeps, newest first, skipping those
+// already in archive and those without full media. Paid items have a trial
+// clip at best, a session which can play them fetches them as not paid
+func itemsToDownload(items []PodcastItem, policy, dir string) ([]PodcastItem, error) {
+	limit, err := downloadLimit(policy)
+	if err != nil || limit == 0 {
+		return nil, err
+	}
+	sortItems(items, false)
+	var ret []PodcastItem
+	kept := 0
+	for _, item := range items {
+		if limit > 0 && kept >= limit {
+			break
+		}
+		if item.Src == "" || item.Paid {
+			continue
+		}
+		// newest N which can be downloaded, archived ones count too
+		kept++
+		if item.LocalPath != "" {
+			if _, err := os.Stat(filepath.Join(dir, item.LocalPath)); err == nil {
+				continue
+			}
+		}
+		ret = append(ret, item)
+	}
+	return ret, nil
+}
+
+// Download fetches media of podcast pid into archive dir according to its
+// download policy, opts.Policy overrides it when set
+func Download(pid string, db *DB, cfg *Config, opts DownloadConfig, log *zap.SugaredLogger) error {
+	meta, err := db.FindPodcastMeta(pid)
+	if err != nil {
+		return err
+	}
+	items, err := db.FindPodcastItems(pid)
+	if err != nil {
+		return err
+	}
+	fc := cfg.Feed(pid)
+	policy := fc.Download
+	if opts.Policy != "" {
+		policy = opts.Policy
+	}
+	dir := cfg.ArchivePath()
+	todo, err := itemsToDownload(items, policy, dir)
+	if err != nil {
+		return err
+	}
+	if len(todo) == 0 {
+		log.Infow("nothing to download", "id", pid, "policy", policy)
+		return nil
+	}
+
+	identity := newHTTPIdentity(cfg.Identity(meta.Source, pid))
+	d := &downloader{
+		source:   meta.Source,
+		client:   &http.Client{Transport: identity.transport(http.DefaultTransport)},
+		identity: identity,
+		limiter:  &rateLimiter{rate: opts.BytesPerSecond},
+		log:      log,
+		covers:   map[string]Tags{},
+	}
+	workers := opts.Concurrency
+	if workers <= 0 {
+		workers = 2
+	}
+
+	jobs := make(chan PodcastItem)
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	failed := 0
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for item := range jobs {
+				v := chooseVariant(item, fc.Quality)
+				if v.URL == "" {
+					continue
+				}
+				rel := ArchivePath(meta.Source, item, v)
+				log.Infow("downloading", "id", pid, "title", item.Title, "path", rel)
+				err := d.fetch(v.URL, filepath.Join(dir, rel))
+				var se *mediaStatusError
+				if errors.As(err, &se) && urlExpired(se.status) {
+					log.Infow("media url expired, asking provider for a fresh one", "id", item.ID, "status", se.status)
+					if item, err = refreshMedia(item, meta, db, cfg, log); err == nil {
+						v = chooseVariant(item, fc.Quality)
+						rel = ArchivePath(meta.Source, item, v)
+						err = d.fetch(v.URL, filepath.Join(dir, rel))
+					}
+				}
+				path := filepath.Join(dir, rel)
+				var sum string
+				if err == nil {
+					// checksum is of the tagged file, as it is kept
+					d.tag(path, meta, item, fc)
+					sum, err = fileChecksum(path)
+				}
+				if err == nil {
+					item.LocalPath, item.Checksum, item.DownloadedAt = rel, sum, time.Now()
+					err = db.SaveItem(item)
+				}
+				if err != nil {
+					log.Errorw("download failed", "title", item.Title, "url", v.URL, "error", err)
+					mu.Lock()
+					failed++
+					mu.Unlock()
+				}
+			}
+		}()
+	}
+	for _, item := range todo {
+		jobs <- item
+	}
+	close(jobs)
+	wg.Wait()
+
+	if failed > 0 {
+		return fmt.Errorf("%d of %d downloads of %s failed", failed, len(todo), pid)
+	}
+	log.Infow("downloads done", "id", pid, "count", len(todo))
+	if fc.LocalEnclosures {
+		// point enclosures of new downloads to the built-in server
+		ProduceRSSFeed(pid, db, cfg, log)
+	}
+	return nil
+}
@@ -0,0 +1,80 @@
+package platform
+
+import (
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dracher/podcast_fetcher/fakeprovider"
+	"go.uber.org/zap"
+)
+
+func TestDownload(t *testing.T) {
+	fakeProvider(t, fakeprovider.New(fakeprovider.Options{MediaTTL: time.Hour}))
+	log := zap.NewNop().Sugar()
+	db := newTestDB(t)
+	cfg := &Config{FeedDir: t.TempDir(), ArchiveDir: t.TempDir(), Feeds: map[string]FeedConfig{"1002": {Download: DownloadAll}}}
+	if err := NewHimalaya("https://www.ximalaya.com/yingshi/1002/", "喜马拉雅", log, db).WithConfig(cfg).FetchAll(true).Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	// the url of track 1 expired since the fetch
+	expired := regexp.MustCompile(`expires=\d+`)
+	item, err := db.FindPodcastItem("10020001")
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale := expired.ReplaceAllString(item.Src, "expires=1")
+	item.Src = stale
+	for i := range item.Variants {
+		item.Variants[i].URL = expired.ReplaceAllString(item.Variants[i].URL, "expires=1")
+	}
+	if err := db.SaveItem(item); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := Download("1002", db, cfg, DownloadConfig{}, log); err != nil {
+		t.Fatal(err)
+	}
+	items, _ := db.FindPodcastItems("1002")
+	for _, item := range items {
+		switch {
+		case item.Paid && item.LocalPath != "":
+			t.Errorf("paid track %d is downloaded", item.Index)
+		case !item.Paid && item.LocalPath == "":
+			t.Errorf("free track %d isn't downloaded", item.Index)
+		case !item.Paid:
+			if !strings.HasSuffix(item.LocalPath, "-"+item.ID+".mp3") {
+				t.Errorf("archive path %s has no track id", item.LocalPath)
+			}
+			if _, err := os.Stat(filepath.Join(cfg.ArchivePath(), item.LocalPath)); err != nil {
+				t.Error(err)
+			}
+		}
+		if item.ID == "10020001" && item.Src == stale {
+			t.Error("expired media url isn't refreshed")
+		}
+	}
+}
+
+func TestItemsToDownloadLatest(t *testing.T) {
+	var items []PodcastItem
+	for n := 1; n <= 6; n++ {
+		items = append(items, PodcastItem{ID: strconv.Itoa(n), Index: n, PubDate: testTime.AddDate(0, 0, n), Src: "https://audio.xmcdn.com/" + strconv.Itoa(n) + ".mp3"})
+	}
+	// newest ones are paid or have no media, they don't take a slot
+	items[5].Paid = true
+	items[4].Src = ""
+	items[3].Paid, items[3].Src = true, ""
+	got, err := itemsToDownload(items, "latest:2", t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 2 || got[0].ID != "3" || got[1].ID != "2" {
+		t.Errorf("latest:2 downloads %+v, want items 3 and 2", got)
+	}
+}
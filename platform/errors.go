@@ -0,0 +1,102 @@
+package platform
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/levigross/grequests"
+)
+
+// errors a provider may return, match them with errors.Is
+var (
+	ErrNotFound       = errors.New("podcast or track not found")
+	ErrRateLimited    = errors.New("rate limited by provider")
+	ErrForbidden      = errors.New("request rejected by provider")
+	ErrPaidContent    = errors.New("content needs purchase or membership")
+	ErrSchemaChanged  = errors.New("provider response doesn't match expected schema")
+	ErrProvider       = errors.New("provider returned an error")
+	ErrSessionExpired = errors.New("provider session isn't logged in anymore")
+)
+
+// ProviderError is what went wrong talking to a provider, Err is one of errors above
+type ProviderError struct {
+	Source string
+	URL    string
+	Status int    // http status code
+	Code   int    // error code in response envelope, e.g. Ret of ximalaya
+	Msg    string // error message in response envelope
+	Err    error
+}
+
+func (e *ProviderError) Error() string {
+	s := fmt.Sprintf("%s: %v (status %d", e.Source, e.Err, e.Status)
+	if e.Code != 0 {
+		s += fmt.Sprintf(", code %d", e.Code)
+	}
+	if e.Msg != "" {
+		s += fmt.Sprintf(", %s", e.Msg)
+	}
+	return s + ") " + e.URL
+}
+
+// Unwrap is
+func (e *ProviderError) Unwrap() error {
+	return e.Err
+}
+
+func statusError(status int) error {
+	switch status {
+	case 401, 403:
+		return ErrForbidden
+	case 402:
+		return ErrPaidContent
+	case 404, 410:
+		return ErrNotFound
+	case 429:
+		return ErrRateLimited
+	}
+	return ErrProvider
+}
+
+// checkResponse turns transport errors and non 200 responses into a ProviderError
+func checkResponse(source, url string, resp *grequests.Response, err error) error {
+	if err != nil {
+		return &ProviderError{Source: source, URL: url, Err: fmt.Errorf("%w: %v", ErrProvider, err)}
+	}
+	if resp.StatusCode != 200 {
+		return &ProviderError{Source: source, URL: url, Status: resp.StatusCode, Err: statusError(resp.StatusCode)}
+	}
+	return nil
+}
+
+// schemaError is returned when a 200 response can't be decoded or misses mandatory fields
+func schemaError(source, url string, err error) error {
+	pe := &ProviderError{Source: source, URL: url, Status: 200, Err: ErrSchemaChanged}
+	if err != nil {
+		pe.Msg = err.Error()
+	}
+	return pe
+}
+
+// ErrorKind is a short name of the errors above, e.g. for cassettes, empty for nil
+func ErrorKind(err error) string {
+	switch {
+	case err == nil:
+		return ""
+	case errors.Is(err, ErrNotFound):
+		return "not_found"
+	case errors.Is(err, ErrRateLimited):
+		return "rate_limited"
+	case errors.Is(err, ErrForbidden):
+		return "forbidden"
+	case errors.Is(err, ErrPaidContent):
+		return "paid"
+	case errors.Is(err, ErrSchemaChanged):
+		return "schema_changed"
+	case errors.Is(err, ErrSessionExpired):
+		return "session_expired"
+	case errors.Is(err, ErrProvider):
+		return "provider"
+	}
+	return "other"
+}
@@ -0,0 +1,215 @@
+package platform
+
+import (
+	"crypto/sha1"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/eduncan911/podcast"
+)
+
+const (
+	itunesNamespace  = "http://www.itunes.com/dtds/podcast-1.0.dtd"
+	podcastNamespace = "https://podcastindex.org/namespace/1.0"
+	atomNamespace    = "http://www.w3.org/2005/Atom"
+)
+
+// podcastGUIDNamespace is the uuid v5 namespace defined by podcastindex for podcast:guid
+var podcastGUIDNamespace = [16]byte{
+	0xea, 0xd4, 0xc2, 0x36, 0xbf, 0x58, 0x58, 0xc6,
+	0xa2, 0xc6, 0xa6, 0xb2, 0x8d, 0x12, 0x8c, 0xb6,
+}
+
+// rssFeed wraps podcast.Podcast so we can emit elements the library doesn't know about
+type rssFeed struct {
+	XMLName      xml.Name `xml:"rss"`
+	Version      string   `xml:"version,attr"`
+	XMLNSItunes  string   `xml:"xmlns:itunes,attr"`
+	XMLNSPodcast string   `xml:"xmlns:podcast,attr"`
+	XMLNSAtom    string   `xml:"xmlns:atom,attr"`
+	Channel      *rssChannel
+}
+
+type rssChannel struct {
+	*podcast.Podcast
+	SelfLink *rssAtomLink
+	IType    string `xml:"itunes:type,omitempty"`
+	GUID     string `xml:"podcast:guid,omitempty"`
+	Locked   *rssLocked
+	Persons  []rssPerson
+	Items    []*rssItem
+
+	meta  PodcastMeta
+	guids map[string]string // item guids by id, overriding itemGUID
+}
+
+type rssItem struct {
+	*podcast.Item
+	GUID       rssGUID
+	IEpisode   int `xml:"itunes:episode,omitempty"`
+	Season     int `xml:"podcast:season,omitempty"`
+	Episode    int `xml:"podcast:episode,omitempty"`
+	Chapters   *rssChapters
+	Transcript *rssTranscript
+	Alternates []rssAlternateEnclosure
+}
+
+type rssAtomLink struct {
+	XMLName xml.Name `xml:"atom:link"`
+	Href    string   `xml:"href,attr"`
+	Rel     string   `xml:"rel,attr"`
+	Type    string   `xml:"type,attr"`
+}
+
+// rssGUID shadows guid of podcast.Item, which is the enclosure url and changes with cdn host
+type rssGUID struct {
+	XMLName     xml.Name `xml:"guid"`
+	IsPermaLink bool     `xml:"isPermaLink,attr"`
+	Value       string   `xml:",chardata"`
+}
+
+type rssLocked struct {
+	XMLName xml.Name `xml:"podcast:locked"`
+	Owner   string   `xml:"owner,attr,omitempty"`
+	Value   string   `xml:",chardata"`
+}
+
+type rssPerson struct {
+	XMLName xml.Name `xml:"podcast:person"`
+	Role    string   `xml:"role,attr,omitempty"`
+	Img     string   `xml:"img,attr,omitempty"`
+	Href    string   `xml:"href,attr,omitempty"`
+	Name    string   `xml:",chardata"`
+}
+
+type rssChapters struct {
+	XMLName xml.Name `xml:"podcast:chapters"`
+	URL     string   `xml:"url,attr"`
+	Type    string   `xml:"type,attr"`
+}
+
+type rssTranscript struct {
+	XMLName xml.Name `xml:"podcast:transcript"`
+	URL     string   `xml:"url,attr"`
+	Type    string   `xml:"type,attr"`
+}
+
+type rssAlternateEnclosure struct {
+	XMLName xml.Name `xml:"podcast:alternateEnclosure"`
+	Type    string   `xml:"type,attr"`
+	Length  int64    `xml:"length,attr,omitempty"`
+	Bitrate int      `xml:"bitrate,attr,omitempty"`
+	Title   string   `xml:"title,attr,omitempty"`
+	Source  rssSource
+}
+
+type rssSource struct {
+	XMLName xml.Name `xml:"podcast:source"`
+	URI     string   `xml:"uri,attr"`
+}
+
+// podcastGUID returns the uuid v5 of feed url as described by podcast namespace spec,
+// scheme and trailing slashes are stripped first
+func podcastGUID(feedURL string) string {
+	if i := strings.Index(feedURL, "://"); i >= 0 {
+		feedURL = feedURL[i+3:]
+	}
+	feedURL = strings.TrimRight(feedURL, "/")
+	h := sha1.New()
+	h.Write(podcastGUIDNamespace[:])
+	h.Write([]byte(feedURL))
+	u := h.Sum(nil)[:16]
+	u[6] = (u[6] & 0x0f) | 0x50
+	u[8] = (u[8] & 0x3f) | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", u[0:4], u[4:6], u[6:8], u[8:10], u[10:16])
+}
+
+// itemGUID is permanent id of item, doesn't depend on any url
+func itemGUID(meta PodcastMeta, item PodcastItem) string {
+	return fmt.Sprintf("%s-%s-%s", meta.Source, item.AlbumID, item.ID)
+}
+
+// newRSSChannel makes the channel of meta, podcast:guid is derived from
+// feedURL, or from the provider link when feeds have no public url
+func newRSSChannel(pd *podcast.Podcast, meta PodcastMeta, fc FeedConfig, feedURL string) *rssChannel {
+	ch := &rssChannel{
+		Podcast: pd,
+		IType:   "episodic",
+		GUID:    podcastGUID(meta.Link),
+		meta:    meta,
+	}
+	if feedURL != "" {
+		ch.GUID = podcastGUID(feedURL)
+	}
+	if fc.Locked != nil && *fc.Locked && fc.Owner.Email != "" {
+		ch.Locked = &rssLocked{Value: "yes", Owner: fc.Owner.Email}
+	}
+	if feedURL != "" {
+		ch.SelfLink = &rssAtomLink{Href: feedURL, Rel: "self", Type: "application/rss+xml"}
+	}
+	if meta.Serial {
+		ch.IType = "serial"
+	}
+	if fc.Type != "" {
+		ch.IType = fc.Type
+	}
+	if meta.AnchorName != "" {
+		ch.Persons = append(ch.Persons, rssPerson{
+			Role: "host",
+			Img:  meta.AnchorImgURL,
+			Href: meta.AnchorLink,
+			Name: meta.AnchorName,
+		})
+	}
+	return ch
+}
+
+// addItem adds item to both library podcast and our wrapper, keep them in the same order
+func (ch *rssChannel) addItem(i podcast.Item, item PodcastItem, alternates []rssAlternateEnclosure) error {
+	if _, err := ch.Podcast.AddItem(i); err != nil {
+		return err
+	}
+	if item.MimeType != "" && i.Enclosure != nil {
+		// library only knows a few types, keep what media server told us
+		ch.Podcast.Items[len(ch.Podcast.Items)-1].Enclosure.TypeFormatted = item.MimeType
+	}
+	ri := &rssItem{
+		Item:     ch.Podcast.Items[len(ch.Podcast.Items)-1],
+		GUID:     rssGUID{Value: itemGUID(ch.meta, item)},
+		IEpisode: item.Episode,
+		Season:   item.Season,
+		Episode:  item.Episode,
+
+		Alternates: alternates,
+	}
+	if item.ChaptersURL != "" {
+		ri.Chapters = &rssChapters{URL: item.ChaptersURL, Type: "application/json+chapters"}
+	}
+	if item.TranscriptURL != "" {
+		t := item.TranscriptType
+		if t == "" {
+			t = "text/plain"
+		}
+		ri.Transcript = &rssTranscript{URL: item.TranscriptURL, Type: t}
+	}
+	if guid, ok := ch.guids[item.ID]; ok {
+		ri.GUID.Value = guid
+	}
+	ch.Items = append(ch.Items, ri)
+	return nil
+}
+
+func (ch *rssChannel) encode(w io.Writer) error {
+	w.Write([]byte(xml.Header))
+	e := xml.NewEncoder(w)
+	e.Indent("", "  ")
+	return e.Encode(rssFeed{
+		Version:      "2.0",
+		XMLNSItunes:  itunesNamespace,
+		XMLNSPodcast: podcastNamespace,
+		XMLNSAtom:    atomNamespace,
+		Channel:      ch,
+	})
+}
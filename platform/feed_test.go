@@ -0,0 +1,138 @@
+package platform
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/asdine/storm"
+	"go.uber.org/zap"
+)
+
+var update = flag.Bool("update", false, "rewrite golden files of testdata")
+
+func newTestDB(t *testing.T) *DB {
+	t.Helper()
+	s, err := storm.Open(filepath.Join(t.TempDir(), "podcasts.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+	return NewDB(s, zap.NewNop().Sugar())
+}
+
+// golden compares got with testdata/name, rewriting it with -update
+func golden(t *testing.T, name string, got []byte) {
+	t.Helper()
+	path := filepath.Join("testdata", name)
+	if *update {
+		if err := ioutil.WriteFile(path, got, 0644); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+	want, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("%s differs from golden file, -update to accept\n%s", name, got)
+	}
+}
+
+var testTime = time.Date(2018, 3, 17, 8, 0, 0, 0, time.UTC)
+
+func fixtureMeta(serial bool) PodcastMeta {
+	return PodcastMeta{
+		Provider:      "喜马拉雅",
+		Source:        "ximalaya",
+		ID:            "1000",
+		Title:         "新闻早知道",
+		Link:          "https://www.ximalaya.com/album/1000",
+		Description:   "每天三分钟，了解天下事 & more",
+		Category:      []string{"News"},
+		LastBuildDate: testTime,
+		PubDate:       testTime,
+		CoverImgURL:   "https://imagev2.xmcdn.com/cover/1000.jpg",
+		IAuthor:       "主播小明",
+		ISummary:      "每天三分钟，了解天下事",
+		AnchorName:    "主播小明",
+		AnchorLink:    "https://www.ximalaya.com/zhubo/42",
+		AnchorImgURL:  "https://imagev2.xmcdn.com/anchor/42.jpg",
+		Serial:        serial,
+	}
+}
+
+func fixtureItems() []PodcastItem {
+	var items []PodcastItem
+	for i, title := range []string{"第1集 开篇：从零开始", "第2集 「进阶」与实践", "Episode 3 <finale>"} {
+		n := i + 1
+		items = append(items, PodcastItem{
+			Title:       title,
+			PubDate:     testTime.Add(time.Duration(n-3) * 24 * time.Hour),
+			Description: fmt.Sprintf("<p>第%d集的介绍</p>", n),
+			Link:        fmt.Sprintf("https://www.ximalaya.com/sound/%d", n),
+			ImageURL:    fmt.Sprintf("https://imagev2.xmcdn.com/track/%d.jpg", n),
+			Duration:    600 * n,
+			Src:         fmt.Sprintf("https://audio.xmcdn.com/%d.m4a", n),
+			ID:          fmt.Sprint(n),
+			AlbumID:     "1000",
+			AlbumName:   "新闻早知道",
+			Index:       n,
+			Length:      int64(1000 * n),
+			MimeType:    "audio/x-m4a",
+			Episode:     n,
+		})
+	}
+	// one item with everything the podcast namespace adds
+	items[1].Season = 2
+	items[1].ChaptersURL = "https://example.com/chapters/2.json"
+	items[1].TranscriptURL = "https://example.com/transcripts/2.srt"
+	items[1].TranscriptType = "application/srt"
+	items[1].Variants = []MediaVariant{
+		{Quality: "64k", Format: "m4a", Bitrate: 64000, URL: items[1].Src},
+		{Quality: "32k", Format: "mp3", Bitrate: 32000, URL: "https://audio.xmcdn.com/2_32.mp3"},
+	}
+	return items
+}
+
+func TestPodcastGUID(t *testing.T) {
+	// example of the podcast namespace spec
+	for _, url := range []string{"mp3s.nashownotes.com/pc20rss.xml", "https://mp3s.nashownotes.com/pc20rss.xml/"} {
+		if got := podcastGUID(url); got != "917393e3-1b1e-5cef-ace4-edaa54e1f810" {
+			t.Errorf("guid of %s is %s", url, got)
+		}
+	}
+}
+
+func TestBuildFeedGolden(t *testing.T) {
+	yes := true
+	owned := Owner{Name: "dracher", Email: "dracher@example.com"}
+	cases := []struct {
+		golden string
+		serial bool
+		cfg    Config
+	}{
+		{"episodic.xml", false, Config{}},
+		{"serial.xml", true, Config{BaseURL: "https://example.com/feeds", Feeds: map[string]FeedConfig{"1000": {AlternateEnclosures: true}}}},
+		{"locked.xml", false, Config{Owner: owned, Feeds: map[string]FeedConfig{"1000": {Locked: &yes}}}},
+		// locked without an owner email stays unlocked
+		{"unowned.xml", false, Config{Owner: Owner{Name: "dracher"}, Locked: true}},
+	}
+	db := newTestDB(t)
+	for _, c := range cases {
+		t.Run(c.golden, func(t *testing.T) {
+			src := feedSource{meta: fixtureMeta(c.serial), items: fixtureItems()}
+			ch := buildFeed("1000", src, db, &c.cfg, zap.NewNop().Sugar())
+			var buf bytes.Buffer
+			if err := ch.encode(&buf); err != nil {
+				t.Fatal(err)
+			}
+			golden(t, c.golden, buf.Bytes())
+		})
+	}
+}
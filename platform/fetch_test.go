@@ -0,0 +1,323 @@
+package platform
+
+import (
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/dracher/podcast_fetcher/fakeprovider"
+	"go.uber.org/zap"
+)
+
+// fakeProvider starts server and sends provider requests to it until the test ends
+func fakeProvider(t *testing.T, server *fakeprovider.Server) {
+	t.Helper()
+	srv := httptest.NewServer(server)
+	old := ProviderTransport
+	ProviderTransport = fakeprovider.Redirect{Base: srv.URL}
+	t.Cleanup(func() {
+		ProviderTransport = old
+		srv.Close()
+	})
+}
+
+type testFeed struct {
+	Channel struct {
+		Items []struct {
+			Title string `xml:"title"`
+		} `xml:"item"`
+	} `xml:"channel"`
+}
+
+// fetchFeed reads feed pid written to cfg
+func fetchFeed(t *testing.T, cfg *Config, pid string) testFeed {
+	t.Helper()
+	data, err := ioutil.ReadFile(cfg.FeedPath(pid))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var feed testFeed
+	if err := xml.Unmarshal(data, &feed); err != nil {
+		t.Fatal(err)
+	}
+	return feed
+}
+
+func TestFetchHimalaya(t *testing.T) {
+	server := fakeprovider.New(fakeprovider.Options{RequireSign: true, PageSize: 10})
+	server.AddAlbum(fakeprovider.Album{ID: "3002", Source: "ximalaya", Title: "老专辑", Anchor: "主播己", Tracks: 3, NoSort: true})
+	fakeProvider(t, server)
+	log := zap.NewNop().Sugar()
+	db := newTestDB(t)
+	cfg := &Config{FeedDir: t.TempDir(), Feeds: map[string]FeedConfig{"1002": {Paid: PaidMarker}}}
+
+	cases := []struct {
+		id     string
+		items  int
+		serial bool
+		feed   int
+	}{
+		{"1000", 75, false, 75},
+		{"1001", 45, true, 45},
+		// tracks 6 to 24 are paid, kept with a marker
+		{"1002", 24, true, 24},
+		// no sort in album info stays episodic
+		{"3002", 3, false, 3},
+	}
+	for _, c := range cases {
+		url := "https://www.ximalaya.com/yingshi/" + c.id + "/"
+		if err := NewHimalaya(url, "喜马拉雅", log, db).WithConfig(cfg).FetchAll(true).Start(); err != nil {
+			t.Fatalf("album %s: %v", c.id, err)
+		}
+		meta, err := db.FindPodcastMeta(c.id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if meta.Title == "" || meta.Serial != c.serial {
+			t.Errorf("album %s: title %q serial %v, want serial %v", c.id, meta.Title, meta.Serial, c.serial)
+		}
+		items, _ := db.FindPodcastItems(c.id)
+		if len(items) != c.items {
+			t.Errorf("album %s: %d items, want %d", c.id, len(items), c.items)
+		}
+		indexes := map[int]bool{}
+		for _, item := range items {
+			indexes[item.Index] = true
+		}
+		if len(indexes) != len(items) || !indexes[1] || !indexes[len(items)] {
+			t.Errorf("album %s: items aren't numbered 1 to %d", c.id, len(items))
+		}
+		if feed := fetchFeed(t, cfg, c.id); len(feed.Channel.Items) != c.feed {
+			t.Errorf("album %s: feed has %d items, want %d", c.id, len(feed.Channel.Items), c.feed)
+		}
+	}
+
+	items, _ := db.FindPodcastItems("1002")
+	paid, sampled := 0, 0
+	for _, item := range items {
+		if item.Index < 6 && (item.Paid || item.Src == "") {
+			t.Errorf("free track %d is paid or has no audio", item.Index)
+		}
+		if item.Index >= 6 {
+			paid++
+			if !item.Paid {
+				t.Errorf("track %d isn't paid", item.Index)
+			}
+			if item.SampleDuration != 0 {
+				sampled++
+			}
+		}
+	}
+	if paid != 19 || sampled == 0 || sampled == paid {
+		t.Errorf("%d paid tracks, %d with a sample", paid, sampled)
+	}
+	marked := 0
+	for _, item := range fetchFeed(t, cfg, "1002").Channel.Items {
+		if strings.HasPrefix(item.Title, paidMarker) {
+			marked++
+		}
+	}
+	if marked != paid {
+		t.Errorf("%d paid items marked in feed, want %d", marked, paid)
+	}
+
+	// latest only asks the first page, numbers stay the ones of the full fetch
+	if err := NewHimalaya("https://www.ximalaya.com/yingshi/1000/", "喜马拉雅", log, db).WithConfig(cfg).Start(); err != nil {
+		t.Fatal(err)
+	}
+	latest, _ := db.FindPodcastItems("1000")
+	if len(latest) != 75 {
+		t.Errorf("latest fetch left %d items, want 75", len(latest))
+	}
+	for _, item := range latest {
+		// fake track ids are album id * 10000 + track number
+		if id, _ := strconv.Atoi(item.ID); id != 10000000+item.Index {
+			t.Errorf("track %s is numbered %d", item.ID, item.Index)
+		}
+	}
+}
+
+func TestFetchLitchi(t *testing.T) {
+	fakeProvider(t, fakeprovider.New(fakeprovider.Options{PageSize: 10}))
+	log := zap.NewNop().Sugar()
+	db := newTestDB(t)
+	cfg := &Config{FeedDir: t.TempDir()}
+
+	if err := NewLitchi("http://www.lizhi.fm/user/2000", "荔枝FM", log, db).WithConfig(cfg).FetchAll(true).Start(); err != nil {
+		t.Fatal(err)
+	}
+	meta, err := db.FindPodcastMeta("2000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if meta.Title != "深夜电台" || meta.IAuthor != "主播丙" {
+		t.Errorf("meta title %q author %q", meta.Title, meta.IAuthor)
+	}
+	if meta.AnchorImgURL != "http://cdn.lizhi.fm/user/2000.jpg" {
+		t.Errorf("anchor image %q isn't the user portrait", meta.AnchorImgURL)
+	}
+	items, _ := db.FindPodcastItems("2000")
+	if len(items) != 41 {
+		t.Errorf("%d items, want 41", len(items))
+	}
+	for _, item := range items {
+		if item.Src == "" || item.Description == "" || item.Index < 1 || item.Index > 41 {
+			t.Errorf("item isn't parsed: %+v", item)
+		}
+	}
+	if feed := fetchFeed(t, cfg, "2000"); len(feed.Channel.Items) != 41 {
+		t.Errorf("feed has %d items, want 41", len(feed.Channel.Items))
+	}
+}
+
+func TestFetchErrors(t *testing.T) {
+	log := zap.NewNop().Sugar()
+	cases := []struct {
+		name string
+		opts fakeprovider.Options
+		url  string
+		want error
+	}{
+		{"ximalaya unknown album", fakeprovider.Options{}, "https://www.ximalaya.com/yingshi/404/", ErrNotFound},
+		{"lizhi unknown user", fakeprovider.Options{}, "http://www.lizhi.fm/user/404", ErrNotFound},
+		{"ximalaya server errors", fakeprovider.Options{ErrorRate: 1}, "https://www.ximalaya.com/yingshi/1000/", ErrProvider},
+		{"lizhi server errors", fakeprovider.Options{ErrorRate: 1}, "http://www.lizhi.fm/user/2000", ErrProvider},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			fakeProvider(t, fakeprovider.New(c.opts))
+			db := newTestDB(t)
+			meta := PodcastMeta{Source: sourceOfURL(c.url), Link: c.url}
+			f, err := newFetcher(meta, fetchOptions{fetchAll: true}, db, &Config{FeedDir: t.TempDir()}, log)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := f.Start(); !errors.Is(err, c.want) {
+				t.Errorf("got %v, want %v", err, c.want)
+			}
+		})
+	}
+}
+
+func TestLitchiSessionExpired(t *testing.T) {
+	fakeProvider(t, fakeprovider.New(fakeprovider.Options{}))
+	log := zap.NewNop().Sugar()
+	db := newTestDB(t)
+	cfg := &Config{FeedDir: t.TempDir()}
+	cookie := SessionCookie{Name: "lz_token", Value: "expired", Domain: ".lizhi.fm", Path: "/"}
+	if err := db.SaveSession(Session{Source: litchiSource, Cookies: []SessionCookie{cookie}}); err != nil {
+		t.Fatal(err)
+	}
+
+	err := NewLitchi("http://www.lizhi.fm/user/2000", "荔枝FM", log, db).WithConfig(cfg).Start()
+	if !errors.Is(err, ErrSessionExpired) {
+		t.Fatalf("got %v, want %v", err, ErrSessionExpired)
+	}
+	if s, err := db.FindSession(litchiSource); err != nil || !s.Expired {
+		t.Errorf("session isn't marked expired: %v", err)
+	}
+	// next run goes as a guest
+	if err := NewLitchi("http://www.lizhi.fm/user/2000", "荔枝FM", log, db).WithConfig(cfg).Start(); err != nil {
+		t.Fatal(err)
+	}
+	if items, _ := db.FindPodcastItems("2000"); len(items) == 0 {
+		t.Error("guest run fetched nothing")
+	}
+}
+
+func TestFetchWithoutTrackCovers(t *testing.T) {
+	server := fakeprovider.New(fakeprovider.Options{})
+	server.AddAlbum(fakeprovider.Album{ID: "3003", Source: "ximalaya", Title: "无封面", Anchor: "主播庚", Tracks: 3, NoCovers: true})
+	server.AddAlbum(fakeprovider.Album{ID: "3004", Source: "lizhi", Title: "无封面电台", Anchor: "主播辛", Tracks: 3, NoCovers: true})
+	fakeProvider(t, server)
+	log := zap.NewNop().Sugar()
+	db := newTestDB(t)
+	cfg := &Config{FeedDir: t.TempDir(), Inboxes: map[string]InboxConfig{"inbox": {}}}
+
+	covers := map[string]string{}
+	for _, url := range []string{"https://www.ximalaya.com/yingshi/3003/", "http://www.lizhi.fm/user/3004"} {
+		meta := PodcastMeta{Source: sourceOfURL(url), Link: url}
+		f, err := newFetcher(meta, fetchOptions{fetchAll: true}, db, cfg, log)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := f.Start(); err != nil {
+			t.Fatal(err)
+		}
+		pid := extractIDFromURL(url)
+		items, _ := db.FindPodcastItems(pid)
+		for _, item := range items {
+			if item.ImageURL != "" {
+				t.Errorf("track %s without a cover has image %q", item.ID, item.ImageURL)
+			}
+		}
+		stored, _ := db.FindPodcastMeta(pid)
+		covers["【"+stored.Title+"】"] = stored.CoverImgURL
+	}
+	if err := ProduceInboxFeed("inbox", db, cfg, log); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := ioutil.ReadFile(cfg.FeedPath("inbox"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var inbox struct {
+		Items []struct {
+			Title string `xml:"title"`
+			Image struct {
+				Href string `xml:"href,attr"`
+			} `xml:"image"`
+		} `xml:"channel>item"`
+	}
+	if err := xml.Unmarshal(data, &inbox); err != nil {
+		t.Fatal(err)
+	}
+	if len(inbox.Items) != 6 {
+		t.Fatalf("inbox has %d items, want 6", len(inbox.Items))
+	}
+	for _, item := range inbox.Items {
+		podcast := item.Title[:strings.Index(item.Title, "】")+len("】")]
+		if want := covers[podcast]; want == "" || item.Image.Href != want {
+			t.Errorf("inbox item %s has image %q, want podcast cover %q", item.Title, item.Image.Href, want)
+		}
+	}
+}
+
+func TestInboxPaidPolicy(t *testing.T) {
+	fakeProvider(t, fakeprovider.New(fakeprovider.Options{}))
+	log := zap.NewNop().Sugar()
+	db := newTestDB(t)
+	cfg := &Config{FeedDir: t.TempDir(), Inboxes: map[string]InboxConfig{"inbox": {Size: 3, Tags: []string{"paid"}}}}
+	// tracks from 6 on of 1002 are paid, odd ones with a sample
+	if err := NewHimalaya("https://www.ximalaya.com/yingshi/1002/", "喜马拉雅", log, db).WithConfig(cfg).FetchAll(true).Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		policy string
+		want   string
+	}{
+		{PaidSkip, "[【付费课程】付费课程 第5集 【付费课程】付费课程 第4集 【付费课程】付费课程 第3集]"},
+		{PaidSample, "[【付费课程】[试听] 付费课程 第23集 【付费课程】[试听] 付费课程 第21集 【付费课程】[试听] 付费课程 第19集]"},
+		{PaidMarker, "[【付费课程】[付费] 付费课程 第24集 【付费课程】[付费][试听] 付费课程 第23集 【付费课程】[付费] 付费课程 第22集]"},
+	}
+	for _, c := range cases {
+		cfg.Feeds = map[string]FeedConfig{"1002": {Tags: []string{"paid"}, Paid: c.policy}}
+		if err := ProduceInboxFeed("inbox", db, cfg, log); err != nil {
+			t.Fatal(err)
+		}
+		var got []string
+		for _, item := range fetchFeed(t, cfg, "inbox").Channel.Items {
+			got = append(got, item.Title)
+		}
+		if fmt.Sprint(got) != c.want {
+			t.Errorf("paid %s: inbox has %v, want %s", c.policy, got, c.want)
+		}
+	}
+}
@@ -0,0 +1,174 @@
+package platform
+
+import (
+	"fmt"
+	"regexp"
+	"time"
+)
+
+// ItemFilter matches items of a feed, every field set must match. Durations
+// are like 90s or 10m, dates are 2006-01-02, items of unknown duration never
+// match duration bounds
+type ItemFilter struct {
+	Title       string // regexp
+	Description string // regexp, html of description is stripped
+	MinDuration string
+	MaxDuration string
+	After       string // published on this day or later
+	Before      string // published before this day
+}
+
+type itemFilter struct {
+	title, description *regexp.Regexp
+	min, max           time.Duration
+	after, before      time.Time
+}
+
+func (f ItemFilter) compile() (itemFilter, error) {
+	var c itemFilter
+	var err error
+	if f.Title != "" {
+		if c.title, err = regexp.Compile(f.Title); err != nil {
+			return c, fmt.Errorf("title filter: %v", err)
+		}
+	}
+	if f.Description != "" {
+		if c.description, err = regexp.Compile(f.Description); err != nil {
+			return c, fmt.Errorf("description filter: %v", err)
+		}
+	}
+	for _, d := range []struct {
+		s   string
+		dst *time.Duration
+	}{{f.MinDuration, &c.min}, {f.MaxDuration, &c.max}} {
+		if d.s == "" {
+			continue
+		}
+		if *d.dst, err = time.ParseDuration(d.s); err != nil {
+			return c, fmt.Errorf("duration filter: %v", err)
+		}
+	}
+	for _, d := range []struct {
+		s   string
+		dst *time.Time
+	}{{f.After, &c.after}, {f.Before, &c.before}} {
+		if d.s == "" {
+			continue
+		}
+		if *d.dst, err = time.ParseInLocation("2006-01-02", d.s, time.Local); err != nil {
+			return c, fmt.Errorf("date filter: %v", err)
+		}
+	}
+	return c, nil
+}
+
+func (f itemFilter) matches(item PodcastItem) bool {
+	duration := time.Duration(item.Duration) * time.Second
+	switch {
+	case f.title != nil && !f.title.MatchString(item.Title):
+	case f.description != nil && !f.description.MatchString(plainText(item.Description)):
+	case f.min != 0 && (duration == 0 || duration < f.min):
+	case f.max != 0 && (duration == 0 || duration > f.max):
+	case !f.after.IsZero() && item.PubDate.Before(f.after):
+	case !f.before.IsZero() && !item.PubDate.Before(f.before):
+	default:
+		return true
+	}
+	return false
+}
+
+// FilterResult tells if an item stays in feed and why
+type FilterResult struct {
+	Item   PodcastItem
+	Kept   bool
+	Reason string
+}
+
+// filters are compiled include and exclude filters of a feed
+type filters struct {
+	include, exclude []itemFilter
+}
+
+func compileFilters(fc FeedConfig) (filters, error) {
+	var fs filters
+	for _, list := range []struct {
+		name string
+		src  []ItemFilter
+		dst  *[]itemFilter
+	}{{"include", fc.Include, &fs.include}, {"exclude", fc.Exclude, &fs.exclude}} {
+		for i, f := range list.src {
+			c, err := f.compile()
+			if err != nil {
+				return fs, fmt.Errorf("%s filter %d: %v", list.name, i+1, err)
+			}
+			*list.dst = append(*list.dst, c)
+		}
+	}
+	return fs, nil
+}
+
+// check tells if item is kept, items are kept when they match any include
+// filter, or there is none, and no exclude filter
+func (fs filters) check(item PodcastItem) FilterResult {
+	r := FilterResult{Item: item}
+	included := len(fs.include) == 0
+	for i, f := range fs.include {
+		if f.matches(item) {
+			included, r.Reason = true, fmt.Sprintf("matches include filter %d", i+1)
+			break
+		}
+	}
+	if !included {
+		r.Reason = "matches no include filter"
+		return r
+	}
+	for i, f := range fs.exclude {
+		if f.matches(item) {
+			r.Reason = fmt.Sprintf("matches exclude filter %d", i+1)
+			return r
+		}
+	}
+	r.Kept = true
+	return r
+}
+
+// filterItems returns items filters of fc keep
+func filterItems(items []PodcastItem, fc FeedConfig) ([]PodcastItem, error) {
+	if len(fc.Include) == 0 && len(fc.Exclude) == 0 {
+		return items, nil
+	}
+	fs, err := compileFilters(fc)
+	if err != nil {
+		return items, err
+	}
+	var kept []PodcastItem
+	for _, item := range items {
+		if fs.check(item).Kept {
+			kept = append(kept, item)
+		}
+	}
+	return kept, nil
+}
+
+// PreviewFilter tells for every item of podcast pid, in feed order, if filters
+// of fc keep it
+func PreviewFilter(pid string, db *DB, fc FeedConfig) ([]FilterResult, error) {
+	meta, err := db.FindPodcastMeta(pid)
+	if err != nil {
+		return nil, err
+	}
+	items, err := db.FindPodcastItems(pid)
+	if err != nil {
+		return nil, err
+	}
+	fs, err := compileFilters(fc)
+	if err != nil {
+		return nil, err
+	}
+	sortItems(items, fc.Type == "serial" || (fc.Type == "" && meta.Serial))
+	var results []FilterResult
+	for _, item := range items {
+		results = append(results, fs.check(item))
+	}
+	return results, nil
+}
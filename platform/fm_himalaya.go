@@ -1,6 +1,7 @@
 package platform
 
 import (
+	"errors"
 	"fmt"
 	"strconv"
 	"time"
@@ -17,15 +18,26 @@ type himalayaPodcastTrack struct {
 	TrackName      string
 	TrackURL       string
 	TrackCoverPath string
+	Index          int
 	Duration       int
 	Src            string
 	AlbumName      string
 	AlbumID        int `storm:"index"`
+	IsPaid         bool
+	HasBuy         bool
+	CanPlay        bool
+	SampleDuration int
+}
+
+// paid if track can't be played in full without purchase or membership
+func (t himalayaPodcastTrack) paid() bool {
+	return t.IsPaid && !t.HasBuy && !t.CanPlay
 }
 
 type (
 	himalayaMetaResponse struct {
 		Ret  int
+		Msg  string
 		Data struct {
 			AlbumID  int
 			MainInfo struct {
@@ -39,11 +51,20 @@ type (
 				RichIntro       string
 				DetailRichIntro string
 			}
+			TracksInfo struct {
+				Sort *int // missing on some albums, they are episodic
+			}
+			AnchorInfo struct {
+				AnchorID    int
+				AnchorName  string
+				AnchorCover string
+			}
 		}
 	}
 
 	himalayaTrackListResponse struct {
 		Ret  int
+		Msg  string
 		Data struct {
 			TracksAudioPlay []himalayaPodcastTrack
 			HasMore         bool
@@ -52,6 +73,7 @@ type (
 
 	himalayaTrackResponse struct {
 		Ret  int
+		Msg  string
 		Data struct {
 			TrackInfo struct {
 				RichIntro  string
@@ -60,22 +82,66 @@ type (
 			}
 		}
 	}
+
+	himalayaCurrentUserResponse struct {
+		Ret  int
+		Msg  string
+		Data struct {
+			UID   int
+			IsVip bool
+		}
+	}
+
+	himalayaTrackAudioResponse struct {
+		Ret  int
+		Msg  string
+		Data struct {
+			TrackID int
+			CanPlay bool
+			IsPaid  bool
+			Src     string
+		}
+	}
+
+	// mobile api, Ret 0 means success
+	himalayaTrackMediaResponse struct {
+		Ret             int
+		Msg             string
+		PlayURL32       string `json:"playUrl32"`
+		PlayURL64       string `json:"playUrl64"`
+		PlayPathAacv164 string
+		PlayPathAacv224 string
+	}
 )
 
+// himalayaRetError checks Ret of revision api envelope, 200 means success and
+// failures mostly reuse http status codes
+func himalayaRetError(url string, ret int, msg string) error {
+	if ret == himalayaRetOK {
+		return nil
+	}
+	return &ProviderError{Source: himalayaSource, URL: url, Status: 200, Code: ret, Msg: msg, Err: statusError(ret)}
+}
+
 // NewHimalaya is
 func NewHimalaya(url,
 	provider string,
 	logger *zap.SugaredLogger,
 	db *DB) *Himalaya {
 	pid := extractIDFromURL(url)
+	client := newArchivingClient(db, himalayaSource, pid)
 	return &Himalaya{
 		meta: PodcastMeta{
 			Provider: provider,
+			Source:   himalayaSource,
 			ID:       pid,
 			Link:     url,
 		},
-		log: logger,
-		db:  db,
+		log:    logger,
+		db:     db,
+		shapes: newShapeRecorder(false),
+		client: client,
+		signer: newXMSigner(himalayaServerTimeQuery, client),
 	}
 }
 
@@ -85,19 +151,65 @@ func (h *Himalaya) FetchAll(all bool) *Himalaya {
 	return h
 }
 
+// requestOptions is requestOptions with xm-sign header injected
+func (h Himalaya) requestOptions() *grequests.RequestOptions {
+	reqOpt := (*Podcast)(&h).requestOptions(himalayaDomain)
+	if !h.offline {
+		reqOpt.BeforeRequest = h.signer.sign
+	}
+	return reqOpt
+}
+
+// Offline rebuilds records from archived responses, without network access
+func (h *Himalaya) Offline() *Himalaya {
+	h.offline = true
+	h.fetchAll = true
+	h.client.Transport = replayTransport{db: h.db}
+	h.client.Jar = nil
+	return h
+}
+
+// Probe if ask media servers for real length and type of enclosures
+func (h *Himalaya) Probe(p bool) *Himalaya {
+	h.probe = p
+	return h
+}
+
+// Strict if report missing and unknown fields of provider responses
+func (h *Himalaya) Strict(s bool) *Himalaya {
+	h.shapes.strict = s
+	return h
+}
+
+// WithConfig sets user config used when producing feed
+func (h *Himalaya) WithConfig(cfg *Config) *Himalaya {
+	(*Podcast)(h).useConfig(cfg)
+	h.signer.identity = h.identity
+	return h
+}
+
 func (h *Himalaya) fetchMeta() error {
 	h.log.Infow("fetching meta information of podcast", "provider", h.meta.Provider, "id", h.meta.ID)
 
-	reqOpt := requestOptions(himalayaDomain)
-	resp, err := grequests.Get(fmt.Sprintf(himalayaPodcastMetaQuery, h.meta.ID), reqOpt)
-	if err != nil || resp.StatusCode != 200 {
+	reqOpt := h.requestOptions()
+	url := fmt.Sprintf(himalayaPodcastMetaQuery, h.meta.ID)
+	resp, err := grequests.Get(url, reqOpt)
+	if err := checkResponse(himalayaSource, url, resp, err); err != nil {
 		h.log.Error(err)
 		return err
 	}
 
 	var meta himalayaMetaResponse
-	err = resp.JSON(&meta)
-	if err != nil {
+	if err := (*Podcast)(h).decode("album", url, resp, &meta); err != nil {
+		h.log.Error(err)
+		return err
+	}
+	if err := himalayaRetError(url, meta.Ret, meta.Msg); err != nil {
+		h.log.Error(err)
+		return err
+	}
+	if meta.Data.MainInfo.AlbumTitle == "" {
+		err := schemaError(himalayaSource, url, errors.New("album title is empty"))
 		h.log.Error(err)
 		return err
 	}
@@ -112,21 +224,37 @@ func (h *Himalaya) fetchMeta() error {
 	h.meta.LastBuildDate = date
 	// TODO get real pubDate, now just minus 2 years
 	h.meta.PubDate = date.AddDate(-2, 0, 0)
-	h.meta.CoverImgURL = fmt.Sprintf("http:%s", meta.Data.MainInfo.Cover)
+	if meta.Data.MainInfo.Cover != "" {
+		h.meta.CoverImgURL = fmt.Sprintf("http:%s", meta.Data.MainInfo.Cover)
+	}
 	h.meta.ISummary = meta.Data.MainInfo.DetailRichIntro
+	// albums listed oldest first are audiobooks or courses meant to be listened in order
+	if sort := meta.Data.TracksInfo.Sort; sort != nil {
+		h.meta.Serial = *sort == himalayaSortAsc
+	}
+	if anchor := meta.Data.AnchorInfo; anchor.AnchorName != "" {
+		h.meta.AnchorName = anchor.AnchorName
+		h.meta.IAuthor = anchor.AnchorName
+		h.meta.AnchorLink = fmt.Sprintf(himalayaAnchorURL, anchor.AnchorID)
+		if anchor.AnchorCover != "" {
+			h.meta.AnchorImgURL = fmt.Sprintf("http:%s", anchor.AnchorCover)
+		}
+	}
 	return nil
 }
 
 func (h Himalaya) fetchTrackMeta(trackID int) (string, time.Time, error) {
-	reqOpt := requestOptions(himalayaDomain)
-	resp, err := grequests.Get(fmt.Sprintf(himalayaItemQuery, trackID), reqOpt)
-	if err != nil || resp.StatusCode != 200 {
-		h.log.Error(err)
+	reqOpt := h.requestOptions()
+	url := fmt.Sprintf(himalayaItemQuery, trackID)
+	resp, err := grequests.Get(url, reqOpt)
+	if err := checkResponse(himalayaSource, url, resp, err); err != nil {
 		return "", time.Now(), err
 	}
 	var track himalayaTrackResponse
-	err = resp.JSON(&track)
-	if err != nil {
+	if err := (*Podcast)(&h).decode("track", url, resp, &track); err != nil {
+		return "", time.Now(), err
+	}
+	if err := himalayaRetError(url, track.Ret, track.Msg); err != nil {
 		return "", time.Now(), err
 	}
 	pubDate, err := time.Parse(himalayaTimeLayout, track.Data.TrackInfo.LastUpdate)
@@ -142,19 +270,102 @@ func (h Himalaya) fetchTrackMeta(trackID int) (string, time.Time, error) {
 	return track.Data.TrackInfo.RichIntro, pubDate, nil
 }
 
+// checkLogin asks ximalaya who is logged in, marks the session expired when nobody is
+func (h *Himalaya) checkLogin(jar *sessionJar) {
+	url := himalayaCurrentUserQuery
+	resp, err := grequests.Get(url, h.requestOptions())
+	if err := checkResponse(himalayaSource, url, resp, err); err != nil {
+		h.log.Warnw("can't check ximalaya session", "error", err)
+		return
+	}
+	var user himalayaCurrentUserResponse
+	// not recorded as a shape, it differs between logged in or not
+	if err := resp.JSON(&user); err != nil {
+		h.log.Warnw("can't check ximalaya session", "error", err)
+		return
+	}
+	if user.Ret != himalayaRetOK || user.Data.UID == 0 {
+		jar.markExpired()
+		(*Podcast)(h).warn("ximalaya session expired, import cookies again to fetch member content")
+		return
+	}
+	h.log.Infow("fetching with stored ximalaya session", "vip", user.Data.IsVip)
+}
+
+// fetchTrackAudio asks a fresh src of track, e.g. when the one from tracklist expired
+func (h Himalaya) fetchTrackAudio(trackID int) (string, error) {
+	url := fmt.Sprintf(himalayaTrackAudioQuery, trackID)
+	resp, err := grequests.Get(url, h.requestOptions())
+	if err := checkResponse(himalayaSource, url, resp, err); err != nil {
+		return "", err
+	}
+	var audio himalayaTrackAudioResponse
+	if err := (*Podcast)(&h).decode("audio", url, resp, &audio); err != nil {
+		return "", err
+	}
+	if err := himalayaRetError(url, audio.Ret, audio.Msg); err != nil {
+		return "", err
+	}
+	if audio.Data.Src == "" {
+		return "", &ProviderError{Source: himalayaSource, URL: url, Status: 200, Msg: "no src", Err: ErrPaidContent}
+	}
+	return audio.Data.Src, nil
+}
+
+// fetchTrackMedia returns audio variants of track besides src given by tracklist
+func (h Himalaya) fetchTrackMedia(trackID int, src string) ([]MediaVariant, error) {
+	variants := []MediaVariant{{Quality: "standard", Format: formatOfURL(src), URL: src}}
+	url := fmt.Sprintf(himalayaTrackMediaQuery, trackID)
+	if (*Podcast)(&h).offlineMissing(url) {
+		return variants, nil
+	}
+	// mobile api isn't signed
+	resp, err := grequests.Get(url, (*Podcast)(&h).requestOptions(himalayaMobileDomain))
+	if err := checkResponse(himalayaSource, url, resp, err); err != nil {
+		return variants, err
+	}
+	var media himalayaTrackMediaResponse
+	if err := (*Podcast)(&h).decode("track_media", url, resp, &media); err != nil {
+		return variants, err
+	}
+	if media.Ret != 0 {
+		return variants, &ProviderError{Source: himalayaSource, URL: url, Status: 200, Code: media.Ret, Msg: media.Msg, Err: ErrProvider}
+	}
+	for _, v := range []MediaVariant{
+		{Quality: "64k", Format: "m4a", Bitrate: 64000, URL: media.PlayPathAacv164},
+		{Quality: "24k", Format: "m4a", Bitrate: 24000, URL: media.PlayPathAacv224},
+		{Quality: "64k", Format: "mp3", Bitrate: 64000, URL: media.PlayURL64},
+		{Quality: "32k", Format: "mp3", Bitrate: 32000, URL: media.PlayURL32},
+	} {
+		if v.URL != "" && v.URL != src {
+			variants = append(variants, v)
+		}
+	}
+	return variants, nil
+}
+
 func (h *Himalaya) fetchTrackList(pageNum int) error {
 	h.log.Debugf("fetching tracklist from page %d", pageNum)
 
-	reqOpt := requestOptions(himalayaDomain)
+	reqOpt := h.requestOptions()
 	var trackList himalayaTrackListResponse
 
-	resp, err := grequests.Get(fmt.Sprintf(himalayaPodcastQuery, h.meta.ID, pageNum), reqOpt)
-	if err != nil || resp.StatusCode != 200 {
+	// always ask newest first, otherwise page 1 of an ascending album is the oldest tracks
+	url := fmt.Sprintf(himalayaPodcastQuery, h.meta.ID, pageNum, himalayaSortDesc)
+	if pageNum > 1 && (*Podcast)(h).offlineMissing(url) {
+		h.log.Infow("no more archived pages", "page", pageNum)
+		return nil
+	}
+	resp, err := grequests.Get(url, reqOpt)
+	if err := checkResponse(himalayaSource, url, resp, err); err != nil {
 		h.log.Error(err)
 		return err
 	}
-	err = resp.JSON(&trackList)
-	if err != nil {
+	if err := (*Podcast)(h).decode("tracklist", url, resp, &trackList); err != nil {
+		h.log.Error(err)
+		return err
+	}
+	if err := himalayaRetError(url, trackList.Ret, trackList.Msg); err != nil {
 		h.log.Error(err)
 		return err
 	}
@@ -163,10 +374,23 @@ func (h *Himalaya) fetchTrackList(pageNum int) error {
 		if err != nil {
 			h.log.Error(err)
 		}
+		var variants []MediaVariant
+		sample := 0
+		if track.paid() {
+			// src of a locked track is empty or a trial clip, no other qualities to ask for
+			if track.Src != "" {
+				sample = track.SampleDuration
+			}
+			h.log.Debugw("track is paid", "track", track.TrackID, "sample", sample)
+		} else {
+			variants, err = h.fetchTrackMedia(track.TrackID, track.Src)
+			if err != nil {
+				h.log.Warnw("can't fetch other qualities of track, only standard one is kept", "track", track.TrackID, "error", err)
+			}
+		}
 		item := PodcastItem{
 			Title:       track.TrackName,
 			Link:        fmt.Sprintf("https://www.ximalaya.com%s", track.TrackURL),
-			ImageURL:    fmt.Sprintf("http:%s", track.TrackCoverPath),
 			Duration:    track.Duration,
 			Src:         track.Src,
 			ID:          strconv.Itoa(track.TrackID),
@@ -174,6 +398,21 @@ func (h *Himalaya) fetchTrackList(pageNum int) error {
 			AlbumName:   track.AlbumName,
 			PubDate:     pubDate,
 			Description: desc,
+			Index:       track.Index,
+			Episode:     track.Index,
+			Variants:    variants,
+
+			Paid:           track.paid(),
+			SampleDuration: sample,
+		}
+		// ImageURL stays empty for tracks without a cover of their own, feeds and
+		// inboxes fall back to the album cover
+		if track.TrackCoverPath != "" {
+			item.ImageURL = fmt.Sprintf("http:%s", track.TrackCoverPath)
+		}
+		if item.Paid && sample == 0 {
+			// nothing playable, don't put a broken enclosure in feed
+			item.Src = ""
 		}
 		h.log.Debugf("fetched track %s", track.TrackName)
 		h.items = append(h.items, item)
@@ -192,6 +431,16 @@ func (h *Himalaya) fetchTrackList(pageNum int) error {
 
 // Start is
 func (h Himalaya) Start() error {
+	started := time.Now()
+	err := h.run()
+	(*Podcast)(&h).finishRun(started, err)
+	return err
+}
+
+func (h *Himalaya) run() error {
+	if jar := (*Podcast)(h).session(); jar != nil {
+		h.checkLogin(jar)
+	}
 	if err := h.fetchMeta(); err != nil {
 		return err
 	}
@@ -207,15 +456,25 @@ func (h Himalaya) Start() error {
 	if err := h.fetchTrackList(1); err != nil {
 		return err
 	}
+	if h.probe {
+		h.log.Info("probing media of fetched items")
+		probeItems(h.items, h.cfg.Feed(h.meta.ID).Quality, h.identity, h.db, h.log)
+	}
 	h.log.Info("save fetched data into database")
 	if err := h.db.SaveMetaData(h); err != nil {
 		return err
 	}
+	if err := forgetPruned(h.meta, h.db, h.cfg); err != nil {
+		return err
+	}
 	if err := h.db.SaveItems(h); err != nil {
 		return err
 	}
+	if _, err := prune(h.meta.ID, h.db, h.cfg, false, h.log); err != nil {
+		return err
+	}
 	h.log.Info("start making rss feed file")
-	ProduceRSSFeed(h.meta.ID, h.db, h.log)
+	ProduceRSSFeed(h.meta.ID, h.db, h.cfg, h.log)
 	return nil
 }
 
@@ -1,6 +1,8 @@
 package platform
 
 import (
+	"encoding/json"
+	"errors"
 	"fmt"
 	"regexp"
 	"strings"
@@ -26,6 +28,23 @@ type litchiPodcastTrack struct {
 	FixedLowPlayURL  string
 }
 
+// variants are the standard, high and low quality audio of track
+func (t litchiPodcastTrack) variants(src string) []MediaVariant {
+	var ret []MediaVariant
+	for _, v := range []MediaVariant{
+		{Quality: "standard", URL: src},
+		{Quality: "high", URL: t.FixedHighPlayURL},
+		{Quality: "low", URL: t.FixedLowPlayURL},
+	} {
+		if v.URL == "" {
+			continue
+		}
+		v.Format = formatOfURL(v.URL)
+		ret = append(ret, v)
+	}
+	return ret
+}
+
 type litchiMetaResponse struct {
 	CdnAudioCover string
 	CdnRadioCover string
@@ -38,6 +57,7 @@ type litchiMetaResponse struct {
 		Band       string
 	}
 	User struct {
+		Name     string
 		Portrait string
 	}
 }
@@ -55,34 +75,71 @@ func NewLitchi(url, provider string, logger *zap.SugaredLogger, db *DB) *Litchi
 	return &Litchi{
 		meta: PodcastMeta{
 			Provider: provider,
+			Source:   litchiSource,
 			ID:       pid,
 			Link:     url,
 		},
-		log: logger,
-		db:  db,
+		log:    logger,
+		db:     db,
+		shapes: newShapeRecorder(false),
+		client: newArchivingClient(db, litchiSource, pid),
 	}
 }
 
-var litchiReqOpt = requestOptions(litchiDomain)
-
 // FetchAll is
 func (l *Litchi) FetchAll(f bool) *Litchi {
 	l.fetchAll = f
 	return l
 }
 
+// Offline rebuilds records from archived responses, without network access
+func (l *Litchi) Offline() *Litchi {
+	l.offline = true
+	l.fetchAll = true
+	l.client.Transport = replayTransport{db: l.db}
+	l.client.Jar = nil
+	return l
+}
+
+// Probe if ask media servers for real length and type of enclosures
+func (l *Litchi) Probe(p bool) *Litchi {
+	l.probe = p
+	return l
+}
+
+// Strict if report missing and unknown fields of provider responses
+func (l *Litchi) Strict(s bool) *Litchi {
+	l.shapes.strict = s
+	return l
+}
+
+// WithConfig sets user config used when producing feed
+func (l *Litchi) WithConfig(cfg *Config) *Litchi {
+	(*Podcast)(l).useConfig(cfg)
+	return l
+}
+
 func (l *Litchi) fetchMeta() error {
 	l.log.Infow("fetching meta information of podcast", "provider", l.meta.Provider, "id", l.meta.ID)
 
-	resp, err := grequests.Get(fmt.Sprintf(litchiPodcastMetaQuery, l.meta.ID), litchiReqOpt)
-	if err != nil || resp.StatusCode != 200 {
+	url := fmt.Sprintf(litchiPodcastMetaQuery, l.meta.ID)
+	resp, err := grequests.Get(url, (*Podcast)(l).requestOptions(litchiDomain))
+	if err := checkResponse(litchiSource, url, resp, err); err != nil {
 		l.log.Error(err)
 		return err
 	}
 
+	if err := l.checkSession(url, resp); err != nil {
+		return err
+	}
 	var meta litchiMetaResponse
-	err = resp.JSON(&meta)
-	if err != nil {
+	if err := (*Podcast)(l).decode("user", url, resp, &meta); err != nil {
+		l.log.Error(err)
+		return err
+	}
+	// lizhi answers unknown users with 200 and an empty radio
+	if meta.Radio.Name == "" {
+		err := &ProviderError{Source: litchiSource, URL: url, Status: resp.StatusCode, Err: ErrNotFound}
 		l.log.Error(err)
 		return err
 	}
@@ -98,23 +155,62 @@ func (l *Litchi) fetchMeta() error {
 	l.meta.PubDate = time.Unix(meta.Radio.CreateTime/1000, 0)
 	l.meta.LastBuildDate = l.meta.PubDate
 	l.meta.CdnAudioCover = meta.CdnAudioCover
+	l.meta.ISummary = meta.Radio.Desc
+	l.meta.IAuthor = meta.User.Name
+	l.meta.AnchorName = meta.User.Name
+	l.meta.AnchorLink = l.meta.Link
+	// the full size portrait of the radio owner, not the cover thumbnail
+	if meta.User.Portrait != "" {
+		l.meta.AnchorImgURL = meta.CdnPortrait + meta.User.Portrait
+	}
 
 	return nil
 }
 
+// checkSession returns ErrSessionExpired when lizhi says the stored session
+// isn't logged in anymore, which is marked expired so next runs go as a guest
+func (l *Litchi) checkSession(url string, resp *grequests.Response) error {
+	var envelope struct {
+		Rcode int
+		Msg   string
+	}
+	// not recorded as a shape, only responses to a logged out session have it
+	if json.Unmarshal(resp.Bytes(), &envelope) != nil || envelope.Rcode != litchiRcodeNotLoggedIn {
+		return nil
+	}
+	if jar, ok := l.client.Jar.(*sessionJar); ok {
+		jar.markExpired()
+		(*Podcast)(l).warn("lizhi session expired, import cookies again to fetch member content")
+	}
+	err := &ProviderError{Source: litchiSource, URL: url, Status: resp.StatusCode, Code: envelope.Rcode, Msg: envelope.Msg, Err: ErrSessionExpired}
+	l.log.Error(err)
+	return err
+}
+
 func (l Litchi) getPageRange() (int, error) {
-	resp, err := grequests.Get(fmt.Sprintf(litchiPodcastQuery, l.meta.ID, 1), litchiReqOpt)
-	if err != nil || resp.StatusCode != 200 {
+	url := fmt.Sprintf(litchiPodcastQuery, l.meta.ID, 1)
+	resp, err := grequests.Get(url, (*Podcast)(&l).requestOptions(litchiDomain))
+	if err := checkResponse(litchiSource, url, resp, err); err != nil {
 		l.log.Error(err)
 		return 0, err
 	}
+	if err := l.checkSession(url, resp); err != nil {
+		return 0, err
+	}
 	var trackList litchiTrackListResponse
-	err = resp.JSON(&trackList)
-	if err != nil {
+	if err := (*Podcast)(&l).decode("audios", url, resp, &trackList); err != nil {
 		l.log.Error(err)
 		return 0, err
 	}
 	t, s := trackList.Total, trackList.Size
+	if s == 0 {
+		if t == 0 {
+			return 1, nil
+		}
+		err := schemaError(litchiSource, url, errors.New("page size is 0"))
+		l.log.Error(err)
+		return 0, err
+	}
 
 	if t < s {
 		return 1, nil
@@ -126,9 +222,9 @@ func (l Litchi) getPageRange() (int, error) {
 
 func (l Litchi) fetchTrackDescription(trackID string) (string, error) {
 	l.log.Debugw("start fetching track description", "trackID", trackID)
-	resp, err := grequests.Get(fmt.Sprintf(litchiTrackInfoQuery, l.meta.Band, trackID), litchiReqOpt)
-	if err != nil || resp.StatusCode != 200 {
-		l.log.Error(err)
+	url := fmt.Sprintf(litchiTrackInfoQuery, l.meta.Band, trackID)
+	resp, err := grequests.Get(url, (*Podcast)(&l).requestOptions(litchiDomain))
+	if err := checkResponse(litchiSource, url, resp, err); err != nil {
 		return "", err
 	}
 
@@ -159,37 +255,56 @@ func (l *Litchi) fetchTrackList(pageNum int) error {
 
 	for index := pageNum; index <= count; index++ {
 		l.log.Debugf("start parsing page %d", index)
-		resp, err := grequests.Get(fmt.Sprintf(litchiPodcastQuery, l.meta.ID, index), litchiReqOpt)
-		if err != nil || resp.StatusCode != 200 {
+		url := fmt.Sprintf(litchiPodcastQuery, l.meta.ID, index)
+		if (*Podcast)(l).offlineMissing(url) {
+			l.log.Infow("page isn't archived", "page", index)
+			continue
+		}
+		resp, err := grequests.Get(url, (*Podcast)(l).requestOptions(litchiDomain))
+		if err := checkResponse(litchiSource, url, resp, err); err != nil {
 			l.log.Error(err)
+			if errors.Is(err, ErrRateLimited) || errors.Is(err, ErrForbidden) {
+				return err
+			}
 			continue
 		}
+		if err := l.checkSession(url, resp); err != nil {
+			return err
+		}
 
 		var trackList litchiTrackListResponse
-		err = resp.JSON(&trackList)
-		if err != nil {
+		if err := (*Podcast)(l).decode("audios", url, resp, &trackList); err != nil {
 			l.log.Error(err)
 			continue
 		}
-		for _, track := range trackList.Audios {
+		for i, track := range trackList.Audios {
 			desc, err := l.fetchTrackDescription(track.ID)
 			l.log.Debugf("get desc %s", desc)
 			if err != nil || desc == "" {
 				l.log.Error(err)
 				desc = track.Name
 			}
+			src := re.ReplaceAllString(track.URL, "cdn")
 			item := PodcastItem{
 				Title:       track.Name,
 				Link:        track.URL,
-				ImageURL:    fmt.Sprintf("%s%s", l.meta.CdnAudioCover, track.Cover),
 				Duration:    track.Duration,
-				Src:         re.ReplaceAllString(track.URL, "cdn"),
+				Src:         src,
 				ID:          track.ID,
 				AlbumID:     l.meta.ID,
 				AlbumName:   l.meta.Title,
 				PubDate:     time.Unix(track.CreateTime/1000, 0),
 				Description: desc,
+				Variants:    track.variants(src),
 			}
+			// ImageURL stays empty for tracks without a cover of their own, feeds and
+			// inboxes fall back to the radio cover
+			if track.Cover != "" {
+				item.ImageURL = l.meta.CdnAudioCover + track.Cover
+			}
+			// lizhi lists newest first, so number backwards from total
+			item.Index = trackList.Total - (index-1)*trackList.Size - i
+			item.Episode = item.Index
 			l.log.Debugf("fetched track %s", track.Name)
 			l.items = append(l.items, item)
 		}
@@ -199,6 +314,16 @@ func (l *Litchi) fetchTrackList(pageNum int) error {
 
 // Start is
 func (l Litchi) Start() error {
+	started := time.Now()
+	err := l.run()
+	(*Podcast)(&l).finishRun(started, err)
+	return err
+}
+
+func (l *Litchi) run() error {
+	if jar := (*Podcast)(l).session(); jar != nil {
+		l.log.Info("fetching with stored lizhi session")
+	}
 	if err := l.fetchMeta(); err != nil {
 		return err
 	}
@@ -216,15 +341,25 @@ func (l Litchi) Start() error {
 		return err
 	}
 
+	if l.probe {
+		l.log.Info("probing media of fetched items")
+		probeItems(l.items, l.cfg.Feed(l.meta.ID).Quality, l.identity, l.db, l.log)
+	}
 	l.log.Info("save fetched data into database")
 	if err := l.db.SaveMetaData(l); err != nil {
 		return err
 	}
+	if err := forgetPruned(l.meta, l.db, l.cfg); err != nil {
+		return err
+	}
 	if err := l.db.SaveItems(l); err != nil {
 		return err
 	}
+	if _, err := prune(l.meta.ID, l.db, l.cfg, false, l.log); err != nil {
+		return err
+	}
 	l.log.Info("start making rss feed file")
-	ProduceRSSFeed(l.meta.ID, l.db, l.log)
+	ProduceRSSFeed(l.meta.ID, l.db, l.cfg, l.log)
 
 	return nil
 }
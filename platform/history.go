@@ -0,0 +1,75 @@
+package platform
+
+import (
+	"time"
+
+	"github.com/levigross/grequests"
+)
+
+// RunRecord is one fetch of a podcast, kept as run history
+type RunRecord struct {
+	ID        int    `storm:"id,increment"`
+	PodcastID string `storm:"index"`
+	Source    string
+	StartedAt time.Time
+	Duration  time.Duration
+	Success   bool
+	Error     string
+	Items     int
+	Warnings  []string
+}
+
+// runsKept is how many runs of a podcast history keeps, older ones are pruned
+const runsKept = 100
+
+// decode unmarshals a provider response and records its shape for drift detection
+func (p *Podcast) decode(endpoint, url string, resp *grequests.Response, v interface{}) error {
+	warnings, err := p.shapes.decode(p.meta.Source+"/"+endpoint, resp.Bytes(), v)
+	if err != nil {
+		return schemaError(p.meta.Source, url, err)
+	}
+	for _, w := range warnings {
+		p.log.Warn(w)
+	}
+	return nil
+}
+
+// warn logs msg and keeps it in history of this run
+func (p *Podcast) warn(msg string) {
+	p.log.Warn(msg)
+	p.warnings = append(p.warnings, msg)
+}
+
+// finishRun records this run in history, response shapes are compared with the
+// last successful run of the podcast in the same mode and become the new
+// baseline when this run succeeds
+func (p *Podcast) finishRun(started time.Time, err error) {
+	run := RunRecord{
+		PodcastID: p.meta.ID,
+		Source:    p.meta.Source,
+		StartedAt: started,
+		Duration:  time.Since(started),
+		Success:   err == nil,
+		Items:     len(p.items),
+		// copied, appending to warnings of recorder could write into its array
+		Warnings: append(append([]string(nil), p.shapes.warnings...), p.warnings...),
+	}
+	if err != nil {
+		run.Error = err.Error()
+	}
+
+	baseline := shapeBaseline(p.meta.Source, p.meta.ID, p.fetchAll)
+	shapes := p.shapes.endpointShapes(baseline)
+	last, dbErr := p.db.FindEndpointShapes(baseline)
+	if dbErr != nil {
+		p.log.Error(dbErr)
+	}
+	for _, w := range compareShapes(last, shapes) {
+		p.log.Warnw("provider response shape changed since last successful run", "detail", w)
+		run.Warnings = append(run.Warnings, w)
+	}
+	if err == nil {
+		p.db.SaveEndpointShapes(shapes)
+	}
+	p.db.SaveRun(run)
+}
@@ -0,0 +1,58 @@
+package platform
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/dracher/podcast_fetcher/fakeprovider"
+	"go.uber.org/zap"
+)
+
+// shapeWarnings are warnings about shape drift of the last run of pid
+func shapeWarnings(t *testing.T, db *DB, pid string) []string {
+	t.Helper()
+	runs, err := db.FindRuns(pid, 1)
+	if err != nil || len(runs) == 0 {
+		t.Fatalf("no run of %s: %v", pid, err)
+	}
+	var ret []string
+	for _, w := range runs[0].Warnings {
+		if strings.Contains(w, "shape changed") {
+			ret = append(ret, w)
+		}
+	}
+	return ret
+}
+
+func TestShapeBaselines(t *testing.T) {
+	server := fakeprovider.New(fakeprovider.Options{PageSize: 10})
+	server.AddAlbum(fakeprovider.Album{ID: "3002", Source: "ximalaya", Title: "老专辑", Anchor: "主播己", Tracks: 3, NoSort: true})
+	fakeProvider(t, server)
+	log := zap.NewNop().Sugar()
+	db := newTestDB(t)
+	cfg := &Config{FeedDir: t.TempDir()}
+	fetch := func(id string, all bool) {
+		t.Helper()
+		if err := NewHimalaya("https://www.ximalaya.com/yingshi/"+id+"/", "喜马拉雅", log, db).WithConfig(cfg).FetchAll(all).Start(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// other albums and latest runs of page 1 only aren't compared with full runs
+	for _, run := range []struct {
+		id  string
+		all bool
+	}{{"1000", true}, {"3002", true}, {"1002", true}, {"1000", false}, {"1000", true}, {"1000", false}} {
+		fetch(run.id, run.all)
+		if w := shapeWarnings(t, db, run.id); len(w) != 0 {
+			t.Errorf("album %s full %v: %v", run.id, run.all, w)
+		}
+	}
+
+	// the same album changing its shape still is
+	server.AddAlbum(fakeprovider.Album{ID: "3002", Source: "ximalaya", Title: "老专辑", Anchor: "主播己", Tracks: 3})
+	fetch("3002", true)
+	if w := shapeWarnings(t, db, "3002"); len(w) == 0 {
+		t.Error("new sort field of album isn't reported")
+	}
+}
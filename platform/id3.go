@@ -0,0 +1,248 @@
+package platform
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf16"
+)
+
+// id3 text encodings
+const (
+	id3Latin1  = 0
+	id3UTF16   = 1
+	id3UTF16BE = 2
+	id3UTF8    = 3
+)
+
+var errNoID3 = errors.New("no id3v2 tag")
+
+func syncsafe(n int) []byte {
+	return []byte{byte(n >> 21 & 0x7f), byte(n >> 14 & 0x7f), byte(n >> 7 & 0x7f), byte(n & 0x7f)}
+}
+
+func unsyncsafe(b []byte) int {
+	return int(b[0])<<21 | int(b[1])<<14 | int(b[2])<<7 | int(b[3])
+}
+
+// id3Frame is a v2.4 frame
+func id3Frame(id string, data []byte) []byte {
+	var buf bytes.Buffer
+	buf.WriteString(id)
+	buf.Write(syncsafe(len(data)))
+	buf.Write([]byte{0, 0})
+	buf.Write(data)
+	return buf.Bytes()
+}
+
+func id3Text(id, s string) []byte {
+	return id3Frame(id, append([]byte{id3UTF8}, s...))
+}
+
+// id3Tag builds an ID3v2.4 tag of t
+func id3Tag(t Tags) []byte {
+	var frames bytes.Buffer
+	if t.Title != "" {
+		frames.Write(id3Text("TIT2", t.Title))
+	}
+	if t.Album != "" {
+		frames.Write(id3Text("TALB", t.Album))
+	}
+	if t.Artist != "" {
+		frames.Write(id3Text("TPE1", t.Artist))
+	}
+	if !t.Date.IsZero() {
+		frames.Write(id3Text("TDRC", t.Date.Format("2006-01-02")))
+	}
+	if t.Track != 0 {
+		frames.Write(id3Text("TRCK", strconv.Itoa(t.Track)))
+	}
+	if t.Description != "" {
+		// encoding, language, empty short description, text
+		data := append([]byte{id3UTF8}, "chi"...)
+		data = append(data, 0)
+		frames.Write(id3Frame("COMM", append(data, t.Description...)))
+	}
+	if len(t.Cover) != 0 {
+		// encoding, mime, front cover, empty description, picture
+		data := append([]byte{id3UTF8}, t.CoverMime...)
+		data = append(data, 0, 3, 0)
+		frames.Write(id3Frame("APIC", append(data, t.Cover...)))
+	}
+	var buf bytes.Buffer
+	buf.WriteString("ID3")
+	buf.Write([]byte{4, 0, 0})
+	buf.Write(syncsafe(frames.Len()))
+	buf.Write(frames.Bytes())
+	return buf.Bytes()
+}
+
+// audioRange returns where audio of an mp3 starts and ends, skipping id3v2
+// tags in front and an id3v1 tag at the end
+func audioRange(fp *os.File) (int64, int64, error) {
+	fi, err := fp.Stat()
+	if err != nil {
+		return 0, 0, err
+	}
+	start, end := int64(0), fi.Size()
+	header := make([]byte, 10)
+	for {
+		if _, err := fp.ReadAt(header, start); err != nil || string(header[:3]) != "ID3" {
+			break
+		}
+		size := int64(unsyncsafe(header[6:10])) + 10
+		if header[5]&0x10 != 0 {
+			// footer
+			size += 10
+		}
+		start += size
+	}
+	tail := make([]byte, 3)
+	if end-start >= 128 {
+		if _, err := fp.ReadAt(tail, end-128); err == nil && string(tail) == "TAG" {
+			end -= 128
+		}
+	}
+	if start > end {
+		return 0, 0, fmt.Errorf("%s has no audio after its tags", fp.Name())
+	}
+	return start, end, nil
+}
+
+// writeID3 copies audio of src to dst behind a new tag, old tags are dropped
+func writeID3(src *os.File, dst io.Writer, t Tags) error {
+	start, end, err := audioRange(src)
+	if err != nil {
+		return err
+	}
+	if _, err := dst.Write(id3Tag(t)); err != nil {
+		return err
+	}
+	_, err = io.Copy(dst, io.NewSectionReader(src, start, end-start))
+	return err
+}
+
+// readID3 reads the id3v2.3 or v2.4 tag at start of r
+func readID3(r io.ReaderAt) (Tags, error) {
+	var t Tags
+	header := make([]byte, 10)
+	if _, err := r.ReadAt(header, 0); err != nil || string(header[:3]) != "ID3" {
+		return t, errNoID3
+	}
+	version := header[3]
+	if version != 3 && version != 4 {
+		return t, fmt.Errorf("id3v2.%d isn't supported", version)
+	}
+	body := make([]byte, unsyncsafe(header[6:10]))
+	if _, err := r.ReadAt(body, 10); err != nil {
+		return t, err
+	}
+	if header[5]&0x40 != 0 && len(body) >= 4 {
+		// extended header
+		size := int(binary.BigEndian.Uint32(body[:4])) + 4
+		if version == 4 {
+			size = unsyncsafe(body[:4])
+		}
+		if size > len(body) {
+			return t, errors.New("broken id3 extended header")
+		}
+		body = body[size:]
+	}
+
+	for len(body) >= 10 && body[0] != 0 {
+		id := string(body[:4])
+		size := int(binary.BigEndian.Uint32(body[4:8]))
+		if version == 4 {
+			size = unsyncsafe(body[4:8])
+		}
+		if 10+size > len(body) {
+			return t, fmt.Errorf("broken id3 frame %s", id)
+		}
+		data := body[10 : 10+size]
+		body = body[10+size:]
+		if len(data) == 0 {
+			continue
+		}
+		enc := data[0]
+		switch id {
+		case "TIT2":
+			t.Title = id3Decode(enc, data[1:])
+		case "TALB":
+			t.Album = id3Decode(enc, data[1:])
+		case "TPE1":
+			t.Artist = id3Decode(enc, data[1:])
+		case "TDRC", "TYER":
+			if d, err := time.Parse("2006-01-02", id3Decode(enc, data[1:])); err == nil {
+				t.Date = d
+			} else if d, err := time.Parse("2006", id3Decode(enc, data[1:])); err == nil {
+				t.Date = d
+			}
+		case "TRCK":
+			// may be track/total
+			t.Track, _ = strconv.Atoi(strings.SplitN(id3Decode(enc, data[1:]), "/", 2)[0])
+		case "COMM":
+			if len(data) > 4 {
+				_, text := id3Split(enc, data[4:])
+				t.Description = id3Decode(enc, text)
+			}
+		case "APIC":
+			mime, rest := id3Split(id3Latin1, data[1:])
+			if len(rest) > 0 {
+				_, pic := id3Split(enc, rest[1:])
+				t.CoverMime, t.Cover = string(mime), pic
+			}
+		}
+	}
+	return t, nil
+}
+
+// id3Split splits b at the string terminator of encoding enc
+func id3Split(enc byte, b []byte) ([]byte, []byte) {
+	if enc == id3UTF16 || enc == id3UTF16BE {
+		for i := 0; i+1 < len(b); i += 2 {
+			if b[i] == 0 && b[i+1] == 0 {
+				return b[:i], b[i+2:]
+			}
+		}
+		return b, nil
+	}
+	if i := bytes.IndexByte(b, 0); i >= 0 {
+		return b[:i], b[i+1:]
+	}
+	return b, nil
+}
+
+// id3Decode decodes text of encoding enc
+func id3Decode(enc byte, b []byte) string {
+	switch enc {
+	case id3UTF16, id3UTF16BE:
+		bigEndian := enc == id3UTF16BE
+		if len(b) >= 2 && b[0] == 0xfe && b[1] == 0xff {
+			bigEndian, b = true, b[2:]
+		} else if len(b) >= 2 && b[0] == 0xff && b[1] == 0xfe {
+			bigEndian, b = false, b[2:]
+		}
+		u := make([]uint16, 0, len(b)/2)
+		for i := 0; i+1 < len(b); i += 2 {
+			if bigEndian {
+				u = append(u, uint16(b[i])<<8|uint16(b[i+1]))
+			} else {
+				u = append(u, uint16(b[i+1])<<8|uint16(b[i]))
+			}
+		}
+		return strings.TrimRight(string(utf16.Decode(u)), "\x00")
+	case id3Latin1:
+		r := make([]rune, len(b))
+		for i, c := range b {
+			r[i] = rune(c)
+		}
+		return strings.TrimRight(string(r), "\x00")
+	}
+	return strings.TrimRight(string(b), "\x00")
+}
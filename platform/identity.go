@@ -0,0 +1,151 @@
+package platform
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/levigross/grequests"
+)
+
+// HTTPConfig is the identity of requests sent to providers, empty fields keep
+// defaults, see Config.Identity for how levels are merged
+type HTTPConfig struct {
+	UserAgents []string // rotated request by request
+	Headers    map[string]string
+	Referer    string
+	Proxy      string // http, https or socks5 url, e.g.: socks5://127.0.0.1:1080
+}
+
+// merge returns c overridden by non empty fields of o, headers are merged
+func (c HTTPConfig) merge(o HTTPConfig) HTTPConfig {
+	if len(o.UserAgents) != 0 {
+		c.UserAgents = o.UserAgents
+	}
+	if len(o.Headers) != 0 {
+		headers := map[string]string{}
+		for k, v := range c.Headers {
+			headers[k] = v
+		}
+		for k, v := range o.Headers {
+			headers[k] = v
+		}
+		c.Headers = headers
+	}
+	if o.Referer != "" {
+		c.Referer = o.Referer
+	}
+	if o.Proxy != "" {
+		c.Proxy = o.Proxy
+	}
+	return c
+}
+
+func (c HTTPConfig) validate() error {
+	if c.Proxy == "" {
+		return nil
+	}
+	u, err := url.Parse(c.Proxy)
+	if err != nil {
+		return fmt.Errorf("proxy %s: %v", c.Proxy, err)
+	}
+	switch u.Scheme {
+	case "http", "https", "socks5", "socks5h":
+		return nil
+	}
+	return fmt.Errorf("proxy %s: scheme must be http, https or socks5", c.Proxy)
+}
+
+// httpIdentity applies an HTTPConfig to requests, it's shared by copies of a
+// provider so rotation goes on
+type httpIdentity struct {
+	HTTPConfig
+
+	mu   sync.Mutex
+	next int
+}
+
+func newHTTPIdentity(c HTTPConfig) *httpIdentity {
+	return &httpIdentity{HTTPConfig: c}
+}
+
+// userAgent returns next user agent of rotation, empty when none is configured
+func (i *httpIdentity) userAgent() string {
+	if i == nil || len(i.UserAgents) == 0 {
+		return ""
+	}
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	ua := i.UserAgents[i.next%len(i.UserAgents)]
+	i.next++
+	return ua
+}
+
+// apply sets user agent, referer and extra headers on reqOpt, safe on nil
+func (i *httpIdentity) apply(reqOpt *grequests.RequestOptions) {
+	if i == nil {
+		return
+	}
+	if ua := i.userAgent(); ua != "" {
+		reqOpt.UserAgent = ua
+	}
+	if i.Referer != "" {
+		reqOpt.Headers["Referer"] = i.Referer
+	}
+	for k, v := range i.Headers {
+		reqOpt.Headers[k] = v
+	}
+}
+
+// transport returns next going through the configured proxy, next is kept as
+// is when it isn't an *http.Transport, e.g. talking to a fake provider
+func (i *httpIdentity) transport(next http.RoundTripper) http.RoundTripper {
+	if i == nil || i.Proxy == "" {
+		return next
+	}
+	t, ok := next.(*http.Transport)
+	if !ok {
+		return next
+	}
+	proxy, err := url.Parse(i.Proxy)
+	if err != nil {
+		return next
+	}
+	t = t.Clone()
+	t.Proxy = http.ProxyURL(proxy)
+	return t
+}
+
+// mediaReferers are sent with media requests of a provider unless a referer is
+// configured, some cdns refuse requests without them
+var mediaReferers = map[string]string{
+	himalayaSource: "https://www.ximalaya.com/",
+	litchiSource:   "https://www.lizhi.fm/",
+}
+
+// mediaRequest builds a request to a media server of source with this identity
+func (i *httpIdentity) mediaRequest(ctx context.Context, method, uri, source string) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(ctx, method, uri, nil)
+	if err != nil {
+		return nil, err
+	}
+	reqOpt := requestOptions(req.URL.Host)
+	reqOpt.Headers["Accept"] = "*/*"
+	if ref := mediaReferers[source]; ref != "" {
+		reqOpt.Headers["Referer"] = ref
+	}
+	i.apply(reqOpt)
+	for k, v := range reqOpt.Headers {
+		req.Header.Set(k, v)
+	}
+	req.Header.Set("User-Agent", reqOpt.UserAgent)
+	return req, nil
+}
+
+// mediaClient is for requests to media servers, which aren't archived
+func (i *httpIdentity) mediaClient() *http.Client {
+	return &http.Client{Transport: i.transport(http.DefaultTransport), Timeout: time.Minute}
+}
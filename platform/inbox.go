@@ -0,0 +1,132 @@
+package platform
+
+import (
+	"fmt"
+	"sort"
+
+	"go.uber.org/zap"
+)
+
+// InboxConfig is a feed of the newest episodes of every podcast, each titled
+// with the name of its podcast. Title and cover of the feed are set by its
+// key in Feeds
+type InboxConfig struct {
+	Size int // newest items kept, default 50
+	// Tags keep podcasts having any of them in Feeds, every podcast when empty
+	Tags []string
+}
+
+const defaultInboxSize = 50
+
+func (c InboxConfig) validate() error {
+	if c.Size < 0 {
+		return fmt.Errorf("inbox size %d is negative", c.Size)
+	}
+	return nil
+}
+
+// has tells if podcast pid belongs to inbox, by tags of its feed
+func (c InboxConfig) has(pid string, cfg *Config) bool {
+	if len(c.Tags) == 0 {
+		return true
+	}
+	for _, want := range c.Tags {
+		for _, tag := range cfg.Feed(pid).Tags {
+			if tag == want {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// inboxesOf returns ids of inbox feeds podcast pid belongs to
+func (c *Config) inboxesOf(pid string) []string {
+	if c == nil {
+		return nil
+	}
+	var ids []string
+	for id, inbox := range c.Inboxes {
+		if inbox.has(pid, c) {
+			ids = append(ids, id)
+		}
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// ProduceInboxFeed generates inbox feed id from stored items of every podcast
+// it has. Items go through filters, title rewrites and the paid policy of
+// their own feed, keep their guid and have the cover of their podcast when
+// they have none
+func ProduceInboxFeed(id string, db *DB, cfg *Config, log *zap.SugaredLogger) error {
+	inbox, ok := cfg.Inboxes[id]
+	if !ok {
+		return fmt.Errorf("no inbox feed %s: %w", id, ErrNotFound)
+	}
+	size := inbox.Size
+	if size == 0 {
+		size = defaultInboxSize
+	}
+	metas, err := db.FindPodcasts()
+	if err != nil {
+		return err
+	}
+
+	src := feedSource{
+		meta: PodcastMeta{
+			ID:          id,
+			Title:       "Inbox",
+			Link:        cfg.FeedURL(id),
+			Description: "newest episodes of every subscription",
+		},
+		guid:  derivedFeedGUID(id, cfg),
+		guids: map[string]string{},
+	}
+	podcasts := 0
+	for _, meta := range metas {
+		if meta.ID == id {
+			return fmt.Errorf("inbox feed %s has the id of a podcast, their feeds would overwrite each other", id)
+		}
+		if !inbox.has(meta.ID, cfg) {
+			continue
+		}
+		podcasts++
+		if meta.Source == "" {
+			meta.Source = sourceOfURL(meta.Link)
+		}
+		fc := cfg.Feed(meta.ID)
+		shown := overrideMeta(meta, fc)
+		items, err := db.FindPodcastItems(meta.ID)
+		if err != nil {
+			return err
+		}
+		if items, err = filterItems(items, fc); err != nil {
+			return err
+		}
+		if items, err = overrideItems(items, fc); err != nil {
+			return err
+		}
+		for _, item := range applyPaidPolicy(items, fc.Paid) {
+			// policy of its own feed is applied, the inbox's one mustn't again
+			item.Paid = false
+			src.guids[item.ID] = itemGUID(meta, item)
+			item.Title = fmt.Sprintf("【%s】%s", shown.Title, item.Title)
+			if item.ImageURL == "" {
+				item.ImageURL = shown.CoverImgURL
+			}
+			src.items = append(src.items, item)
+		}
+	}
+
+	sortItems(src.items, false)
+	if len(src.items) > size {
+		src.items = src.items[:size]
+	}
+	if len(src.items) > 0 {
+		src.meta.PubDate, src.meta.LastBuildDate = src.items[0].PubDate, src.items[0].PubDate
+	}
+	log.Infow("making inbox feed", "id", id, "podcasts", podcasts, "items", len(src.items))
+	writeFeed(id, src, db, cfg, log)
+	return nil
+}
@@ -1,14 +1,17 @@
 package platform
 
 import (
+	"net/http"
 	"time"
 
+	"github.com/levigross/grequests"
 	"go.uber.org/zap"
 )
 
 // PodcastMeta is
 type PodcastMeta struct {
 	Provider      string // e.g.: 喜马拉雅，荔枝...
+	Source        string // ascii key of provider, e.g.: ximalaya, lizhi
 	ID            string `storm:"id"`
 	Title         string
 	Link          string
@@ -19,6 +22,10 @@ type PodcastMeta struct {
 	CoverImgURL   string
 	IAuthor       string
 	ISummary      string
+	AnchorName    string
+	AnchorLink    string
+	AnchorImgURL  string
+	Serial        bool // listened in order, oldest first
 
 	CdnAudioCover string // lizhifm specific
 	Band          string // lizhifm specific
@@ -36,6 +43,26 @@ type PodcastItem struct {
 	ID          string `storm:"id"`
 	AlbumID     string `storm:"index"`
 	AlbumName   string
+	Index       int    // position of track in album given by provider, 1 is the oldest
+	Length      int64  // enclosure size in bytes, 0 when not probed
+	MimeType    string // enclosure type reported by media server
+
+	Season         int
+	Episode        int
+	ChaptersURL    string // podcast:chapters json
+	TranscriptURL  string
+	TranscriptType string
+
+	Variants []MediaVariant // every quality and format provider offers, Src is one of them
+
+	// Paid items need purchase or membership, their Src is empty or only a sample
+	Paid           bool
+	SampleDuration int // seconds of the sample in Src of a paid item, 0 when there's none
+
+	// kept by download, LocalPath is relative to archive dir
+	LocalPath    string
+	Checksum     string // sha256 of the downloaded file
+	DownloadedAt time.Time
 }
 
 // Podcast is
@@ -44,7 +71,38 @@ type Podcast struct {
 	items    []PodcastItem
 	log      *zap.SugaredLogger
 	fetchAll bool
+	probe    bool
 	db       *DB
+	cfg      *Config
+	shapes   *shapeRecorder
+	client   *http.Client
+	offline  bool // replay archived responses instead of network
+	warnings []string
+	identity *httpIdentity
+
+	signer *xmSigner // ximalaya specific
+}
+
+// requestOptions is requestOptions going through the podcast http client
+func (p *Podcast) requestOptions(hostDomain string) *grequests.RequestOptions {
+	reqOpt := requestOptions(hostDomain)
+	reqOpt.HTTPClient = p.client
+	p.identity.apply(reqOpt)
+	return reqOpt
+}
+
+// useConfig keeps cfg and applies http identity of this podcast to requests
+func (p *Podcast) useConfig(cfg *Config) {
+	p.cfg = cfg
+	p.identity = newHTTPIdentity(cfg.Identity(p.meta.Source, p.meta.ID))
+	if t, ok := p.client.Transport.(*archiveTransport); ok {
+		t.next = p.identity.transport(t.next)
+	}
+}
+
+// offlineMissing if we are replaying archive and url was never archived
+func (p *Podcast) offlineMissing(url string) bool {
+	return p.offline && !p.db.HasRawResponse(url)
 }
 
 // IPodcastMeta is
@@ -0,0 +1,315 @@
+package platform
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// mp4Box is an atom of an mp4 file, offset and size include its header
+type mp4Box struct {
+	typ    string
+	offset int64
+	size   int64
+	header int64
+}
+
+// mp4Boxes lists boxes in r between start and end
+func mp4Boxes(r io.ReaderAt, start, end int64) ([]mp4Box, error) {
+	var boxes []mp4Box
+	buf := make([]byte, 16)
+	for off := start; off+8 <= end; {
+		if _, err := r.ReadAt(buf[:8], off); err != nil {
+			return nil, err
+		}
+		b := mp4Box{typ: string(buf[4:8]), offset: off, size: int64(binary.BigEndian.Uint32(buf[:4])), header: 8}
+		switch b.size {
+		case 0:
+			// to the end
+			b.size = end - off
+		case 1:
+			if _, err := r.ReadAt(buf[8:16], off+8); err != nil {
+				return nil, err
+			}
+			b.size, b.header = int64(binary.BigEndian.Uint64(buf[8:16])), 16
+		}
+		if b.size < b.header || off+b.size > end {
+			return nil, fmt.Errorf("broken mp4 box %q at %d", b.typ, off)
+		}
+		boxes = append(boxes, b)
+		off += b.size
+	}
+	return boxes, nil
+}
+
+func findBox(boxes []mp4Box, typ string) (mp4Box, bool) {
+	for _, b := range boxes {
+		if b.typ == typ {
+			return b, true
+		}
+	}
+	return mp4Box{}, false
+}
+
+func makeBox(typ string, payload ...[]byte) []byte {
+	size := 8
+	for _, p := range payload {
+		size += len(p)
+	}
+	buf := make([]byte, 8, size)
+	binary.BigEndian.PutUint32(buf, uint32(size))
+	copy(buf[4:], typ)
+	for _, p := range payload {
+		buf = append(buf, p...)
+	}
+	return buf
+}
+
+// ilst data types
+const (
+	mp4Implicit = 0
+	mp4UTF8     = 1
+	mp4JPEG     = 13
+	mp4PNG      = 14
+)
+
+// ilstItem is an iTunes metadata item with a single data box
+func ilstItem(typ string, dataType uint32, value []byte) []byte {
+	head := make([]byte, 8) // type, locale
+	binary.BigEndian.PutUint32(head, dataType)
+	return makeBox(typ, makeBox("data", head, value))
+}
+
+// mp4Meta builds udta/meta of t
+func mp4Meta(t Tags) []byte {
+	var items [][]byte
+	text := func(typ, s string) {
+		if s != "" {
+			items = append(items, ilstItem(typ, mp4UTF8, []byte(s)))
+		}
+	}
+	text("\xa9nam", t.Title)
+	text("\xa9alb", t.Album)
+	text("\xa9ART", t.Artist)
+	if !t.Date.IsZero() {
+		text("\xa9day", t.Date.Format("2006-01-02"))
+	}
+	if t.Track > 0 {
+		// reserved, track, total, reserved
+		trkn := make([]byte, 8)
+		binary.BigEndian.PutUint16(trkn[2:], uint16(t.Track))
+		items = append(items, ilstItem("trkn", mp4Implicit, trkn))
+	}
+	text("desc", t.Description)
+	text("\xa9cmt", t.Description)
+	if len(t.Cover) != 0 {
+		typ := uint32(mp4JPEG)
+		if t.CoverMime == "image/png" {
+			typ = mp4PNG
+		}
+		items = append(items, ilstItem("covr", typ, t.Cover))
+	}
+
+	// version and flags, pre defined, handler, reserved, empty name
+	hdlr := append(make([]byte, 8), "mdirappl"...)
+	hdlr = append(hdlr, make([]byte, 9)...)
+	return makeBox("meta", make([]byte, 4), makeBox("hdlr", hdlr), makeBox("ilst", items...))
+}
+
+// newMoov is moov with meta of its udta replaced, other boxes are kept as they are
+func newMoov(moov []byte, header int64, meta []byte) ([]byte, error) {
+	r := bytes.NewReader(moov)
+	children, err := mp4Boxes(r, header, int64(len(moov)))
+	if err != nil {
+		return nil, err
+	}
+	var payload [][]byte
+	hasUdta := false
+	for _, c := range children {
+		box := moov[c.offset : c.offset+c.size]
+		if c.typ == "udta" {
+			hasUdta = true
+			grand, err := mp4Boxes(r, c.offset+c.header, c.offset+c.size)
+			if err != nil {
+				return nil, err
+			}
+			var udta [][]byte
+			for _, g := range grand {
+				if g.typ != "meta" {
+					udta = append(udta, moov[g.offset:g.offset+g.size])
+				}
+			}
+			box = makeBox("udta", append(udta, meta)...)
+		}
+		payload = append(payload, box)
+	}
+	if !hasUdta {
+		payload = append(payload, makeBox("udta", meta))
+	}
+	return makeBox("moov", payload...), nil
+}
+
+// shiftChunkOffsets adds delta to stco and co64 entries of moov pointing past from
+func shiftChunkOffsets(moov []byte, start, end int64, from, delta int64) error {
+	r := bytes.NewReader(moov)
+	boxes, err := mp4Boxes(r, start, end)
+	if err != nil {
+		return err
+	}
+	for _, b := range boxes {
+		switch b.typ {
+		case "trak", "mdia", "minf", "stbl":
+			if err := shiftChunkOffsets(moov, b.offset+b.header, b.offset+b.size, from, delta); err != nil {
+				return err
+			}
+		case "stco", "co64":
+			body := moov[b.offset+b.header : b.offset+b.size]
+			if len(body) < 8 {
+				return fmt.Errorf("broken %s", b.typ)
+			}
+			n := int(binary.BigEndian.Uint32(body[4:8]))
+			width := 4
+			if b.typ == "co64" {
+				width = 8
+			}
+			if 8+n*width > len(body) {
+				return fmt.Errorf("broken %s", b.typ)
+			}
+			for i := 0; i < n; i++ {
+				entry := body[8+i*width:]
+				if width == 4 {
+					if off := int64(binary.BigEndian.Uint32(entry)); off >= from {
+						binary.BigEndian.PutUint32(entry, uint32(off+delta))
+					}
+				} else if off := int64(binary.BigEndian.Uint64(entry)); off >= from {
+					binary.BigEndian.PutUint64(entry, uint64(off+delta))
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// writeMP4Tags copies src to dst with new iTunes metadata in moov. When moov
+// comes before media data, chunk offsets are moved by its change of size
+func writeMP4Tags(src *os.File, dst io.Writer, t Tags) error {
+	fi, err := src.Stat()
+	if err != nil {
+		return err
+	}
+	boxes, err := mp4Boxes(src, 0, fi.Size())
+	if err != nil {
+		return err
+	}
+	moovBox, ok := findBox(boxes, "moov")
+	if !ok {
+		return fmt.Errorf("%s has no moov box", src.Name())
+	}
+	moov := make([]byte, moovBox.size)
+	if _, err := src.ReadAt(moov, moovBox.offset); err != nil {
+		return err
+	}
+	moov, err = newMoov(moov, moovBox.header, mp4Meta(t))
+	if err != nil {
+		return err
+	}
+	if delta := int64(len(moov)) - moovBox.size; delta != 0 {
+		if err := shiftChunkOffsets(moov, 8, int64(len(moov)), moovBox.offset+moovBox.size, delta); err != nil {
+			return err
+		}
+	}
+
+	if _, err := io.Copy(dst, io.NewSectionReader(src, 0, moovBox.offset)); err != nil {
+		return err
+	}
+	if _, err := dst.Write(moov); err != nil {
+		return err
+	}
+	after := moovBox.offset + moovBox.size
+	_, err = io.Copy(dst, io.NewSectionReader(src, after, fi.Size()-after))
+	return err
+}
+
+// readMP4Tags reads iTunes metadata of moov/udta/meta/ilst
+func readMP4Tags(fp *os.File) (Tags, error) {
+	var t Tags
+	fi, err := fp.Stat()
+	if err != nil {
+		return t, err
+	}
+	boxes, err := mp4Boxes(fp, 0, fi.Size())
+	if err != nil {
+		return t, err
+	}
+	box, ok := findBox(boxes, "moov")
+	for _, typ := range []string{"udta", "meta", "ilst"} {
+		if !ok {
+			return t, errors.New("no mp4 metadata")
+		}
+		start := box.offset + box.header
+		if box.typ == "meta" {
+			// meta is a full box
+			start += 4
+		}
+		if boxes, err = mp4Boxes(fp, start, box.offset+box.size); err != nil {
+			return t, err
+		}
+		box, ok = findBox(boxes, typ)
+	}
+	if !ok {
+		return t, errors.New("no mp4 metadata")
+	}
+	items, err := mp4Boxes(fp, box.offset+box.header, box.offset+box.size)
+	if err != nil {
+		return t, err
+	}
+	for _, item := range items {
+		buf := make([]byte, item.size-item.header)
+		if _, err := fp.ReadAt(buf, item.offset+item.header); err != nil {
+			return t, err
+		}
+		if len(buf) < 16 || string(buf[4:8]) != "data" {
+			continue
+		}
+		dataType := binary.BigEndian.Uint32(buf[8:12]) & 0xffffff
+		value := buf[16:]
+		switch item.typ {
+		case "\xa9nam":
+			t.Title = string(value)
+		case "\xa9alb":
+			t.Album = string(value)
+		case "\xa9ART":
+			t.Artist = string(value)
+		case "\xa9day":
+			if d, err := time.Parse("2006-01-02", string(value)); err == nil {
+				t.Date = d
+			} else if len(value) >= 4 {
+				if y, err := strconv.Atoi(string(value[:4])); err == nil {
+					t.Date = time.Date(y, 1, 1, 0, 0, 0, 0, time.UTC)
+				}
+			}
+		case "trkn":
+			if len(value) >= 4 {
+				t.Track = int(binary.BigEndian.Uint16(value[2:4]))
+			}
+		case "desc":
+			t.Description = string(value)
+		case "\xa9cmt":
+			if t.Description == "" {
+				t.Description = strings.TrimSpace(string(value))
+			}
+		case "covr":
+			t.Cover, t.CoverMime = value, "image/jpeg"
+			if dataType == mp4PNG {
+				t.CoverMime = "image/png"
+			}
+		}
+	}
+	return t, nil
+}
@@ -0,0 +1,70 @@
+package platform
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// TitleRewrite replaces matches of Pattern in item titles with Replace, where
+// $1 or ${name} expand to groups of the match
+type TitleRewrite struct {
+	Pattern string
+	Replace string
+}
+
+type titleRewrite struct {
+	re      *regexp.Regexp
+	replace string
+}
+
+func compileRewrites(rewrites []TitleRewrite) ([]titleRewrite, error) {
+	var ret []titleRewrite
+	for i, r := range rewrites {
+		re, err := regexp.Compile(r.Pattern)
+		if err != nil {
+			return nil, fmt.Errorf("title rewrite %d: %v", i+1, err)
+		}
+		ret = append(ret, titleRewrite{re: re, replace: r.Replace})
+	}
+	return ret, nil
+}
+
+// overrideMeta is meta with fields set in fc instead of what provider says
+func overrideMeta(meta PodcastMeta, fc FeedConfig) PodcastMeta {
+	if fc.Title != "" {
+		meta.Title = fc.Title
+	}
+	if fc.Description != "" {
+		meta.Description, meta.ISummary = fc.Description, fc.Description
+	}
+	if fc.Author != "" {
+		meta.IAuthor = fc.Author
+	}
+	if fc.Category != "" {
+		meta.Category = strings.Split(fc.Category, "/")
+	}
+	if fc.Cover != "" {
+		meta.CoverImgURL = fc.Cover
+	}
+	return meta
+}
+
+// overrideItems rewrites titles of items by fc, and their album name when
+// the title of the feed is overridden. Rewrites go in order, each one on the
+// result of the one before
+func overrideItems(items []PodcastItem, fc FeedConfig) ([]PodcastItem, error) {
+	rewrites, err := compileRewrites(fc.TitleRewrites)
+	if err != nil {
+		return items, err
+	}
+	for i := range items {
+		for _, r := range rewrites {
+			items[i].Title = strings.TrimSpace(r.re.ReplaceAllString(items[i].Title, r.replace))
+		}
+		if fc.Title != "" {
+			items[i].AlbumName = fc.Title
+		}
+	}
+	return items, nil
+}
@@ -0,0 +1,44 @@
+package platform
+
+import "fmt"
+
+// what to do with paid items in feed, set by FeedConfig.Paid
+const (
+	PaidSkip   = "skip"   // leave them out, the default
+	PaidMarker = "marker" // keep them with a marker in title, enclosure is the sample if any
+	PaidSample = "sample" // keep only those having a sample, with the sample as enclosure
+)
+
+const (
+	paidMarker   = "[付费]"
+	sampleMarker = "[试听]"
+)
+
+// applyPaidPolicy returns items to put in feed according to policy, free items are always kept
+func applyPaidPolicy(items []PodcastItem, policy string) []PodcastItem {
+	var ret []PodcastItem
+	for _, item := range items {
+		if !item.Paid {
+			ret = append(ret, item)
+			continue
+		}
+		switch policy {
+		case PaidMarker:
+			if item.SampleDuration != 0 {
+				item.Title = fmt.Sprintf("%s%s %s", paidMarker, sampleMarker, item.Title)
+				item.Duration = item.SampleDuration
+			} else {
+				item.Title = fmt.Sprintf("%s %s", paidMarker, item.Title)
+			}
+			ret = append(ret, item)
+		case PaidSample:
+			if item.SampleDuration == 0 {
+				continue
+			}
+			item.Title = fmt.Sprintf("%s %s", sampleMarker, item.Title)
+			item.Duration = item.SampleDuration
+			ret = append(ret, item)
+		}
+	}
+	return ret
+}
@@ -6,23 +6,41 @@ const (
 	litchiPodcastQuery     = "http://www.lizhi.fm/api/user/audios/%s/%d"
 	litchiPodcastMetaQuery = "http://www.lizhi.fm/api/user/info/%s"
 	litchiTrackInfoQuery   = "http://www.lizhi.fm/%s/%s"
-	litchiDomain           = "ww.lizhi.fm"
+	litchiDomain           = "www.lizhi.fm"
+	litchiSource           = "lizhi"
+	// litchiRcodeNotLoggedIn is the rcode of api responses to a logged out session
+	litchiRcodeNotLoggedIn = 2
 
 	himalayaPodcastMetaQuery = "https://www.ximalaya.com/revision/album?albumId=%s"
-	himalayaPodcastQuery     = "https://www.ximalaya.com/revision/play/album?albumId=%s&pageNum=%d"
+	himalayaPodcastQuery     = "https://www.ximalaya.com/revision/play/album?albumId=%s&pageNum=%d&sort=%d"
 	himalayaItemQuery        = "https://www.ximalaya.com/revision/track/trackPageInfo?trackId=%d"
+	himalayaServerTimeQuery  = "https://www.ximalaya.com/revision/time"
+	himalayaCurrentUserQuery = "https://www.ximalaya.com/revision/main/getCurrentUser"
+	himalayaTrackAudioQuery  = "https://www.ximalaya.com/revision/play/v1/audio?id=%d&ptype=1"
+	himalayaTrackMediaQuery  = "http://mobile.ximalaya.com/v1/track/baseInfo?device=android&trackId=%d"
+	himalayaAnchorURL        = "https://www.ximalaya.com/zhubo/%d/"
 	himalayaTimeLayout       = "2006-01-02 15:04:05"
 	himalayaTimeLayoutShort  = "2006-01-02"
 	himalayaDomain           = "www.ximalaya.com"
+	himalayaMobileDomain     = "mobile.ximalaya.com"
+	himalayaSource           = "ximalaya"
+	himalayaRetOK            = 200
+	himalayaSortAsc          = 0
+	himalayaSortDesc         = 1
 )
 
+// defaultUserAgent is used unless user agents are configured, see HTTPConfig
+const defaultUserAgent = "Mozilla/5.0 (X11; Ubuntu; Linux x86_64; rv:128.0) Gecko/20100101 Firefox/128.0"
+
 func requestOptions(hostDomain string) *grequests.RequestOptions {
 	return &grequests.RequestOptions{
 		Headers: map[string]string{
 			"Accept":                    "text/html,application/xhtml+xml,application/xml;q=0.9,*/*;q=0.8",
-			"User-Agent":                "Mozilla/5.0 (X11; Ubuntu; Linux x86_64; rv:63.0) Gecko/20100101 Firefox/63.0",
-			"Host":                      hostDomain,
 			"Upgrade-Insecure-Requests": "1",
 		},
+		// grequests replaces a User-Agent header with its own, it has to go here
+		UserAgent: defaultUserAgent,
+		// a Host header is ignored by net/http, it has to go here
+		Host: hostDomain,
 	}
 }
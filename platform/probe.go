@@ -0,0 +1,110 @@
+package platform
+
+import (
+	"errors"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/levigross/grequests"
+	"go.uber.org/zap"
+)
+
+// MediaProbe is cached result of probing a media url
+type MediaProbe struct {
+	URL      string `storm:"id"`
+	Length   int64
+	MimeType string
+	ProbedAt time.Time
+}
+
+var errProbeFailed = errors.New("can't get length of media")
+
+// probeMedia asks the media server for size and type of url, HEAD first,
+// then a one byte ranged GET for servers which don't answer HEAD properly
+func probeMedia(uri string, id *httpIdentity) (MediaProbe, error) {
+	probe := MediaProbe{URL: uri, ProbedAt: time.Now()}
+	host := ""
+	if u, err := url.Parse(uri); err == nil {
+		host = u.Host
+	}
+
+	reqOpt := requestOptions(host)
+	reqOpt.HTTPClient = id.mediaClient()
+	id.apply(reqOpt)
+	resp, err := grequests.Head(uri, reqOpt)
+	if err == nil {
+		resp.Close()
+		if resp.StatusCode == 200 && resp.RawResponse.ContentLength > 0 {
+			probe.Length = resp.RawResponse.ContentLength
+			probe.MimeType = mimeType(resp.Header.Get("Content-Type"))
+			return probe, nil
+		}
+	}
+
+	reqOpt.Headers["Range"] = "bytes=0-0"
+	resp, err = grequests.Get(uri, reqOpt)
+	if err != nil {
+		return probe, err
+	}
+	// body is never read, a server ignoring Range sends the whole file
+	defer resp.Close()
+	switch resp.StatusCode {
+	case 200:
+		if resp.RawResponse.ContentLength <= 0 {
+			return probe, errProbeFailed
+		}
+		probe.Length = resp.RawResponse.ContentLength
+	case 206:
+		// Content-Range: bytes 0-0/12345
+		cr := resp.Header.Get("Content-Range")
+		i := strings.LastIndex(cr, "/")
+		if i < 0 {
+			return probe, errProbeFailed
+		}
+		probe.Length, err = strconv.ParseInt(cr[i+1:], 10, 64)
+		if err != nil {
+			return probe, errProbeFailed
+		}
+	default:
+		return probe, errProbeFailed
+	}
+	probe.MimeType = mimeType(resp.Header.Get("Content-Type"))
+	return probe, nil
+}
+
+// mimeType strips parameters and drops useless generic types
+func mimeType(contentType string) string {
+	t := strings.TrimSpace(strings.Split(contentType, ";")[0])
+	if t == "application/octet-stream" || t == "binary/octet-stream" {
+		return ""
+	}
+	return t
+}
+
+// probeItems probes the variant of each item chosen by prefs, results are cached
+// by url in db, Length and MimeType of items are filled when it is their Src
+func probeItems(items []PodcastItem, prefs []string, id *httpIdentity, db *DB, log *zap.SugaredLogger) {
+	for i := range items {
+		item := &items[i]
+		url := chooseVariant(*item, prefs).URL
+		if url == "" {
+			continue
+		}
+		probe, err := db.FindMediaProbe(url)
+		if err != nil {
+			log.Debugw("probing media", "url", url)
+			probe, err = probeMedia(url, id)
+			if err != nil {
+				log.Warnw("probe media failed", "url", url, "error", err)
+				continue
+			}
+			db.SaveMediaProbe(probe)
+		}
+		if url == item.Src {
+			item.Length = probe.Length
+			item.MimeType = probe.MimeType
+		}
+	}
+}
@@ -0,0 +1,58 @@
+package platform
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestProbeMedia(t *testing.T) {
+	body := strings.Repeat("x", 4096)
+	cases := []struct {
+		name    string
+		handler http.HandlerFunc
+		length  int64
+		err     error
+	}{
+		{"head", func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "audio/mpeg")
+			w.Header().Set("Content-Length", "4096")
+			w.Write([]byte(body))
+		}, 4096, nil},
+		{"ranged get", func(w http.ResponseWriter, r *http.Request) {
+			if r.Method == "HEAD" {
+				w.WriteHeader(http.StatusMethodNotAllowed)
+				return
+			}
+			w.Header().Set("Content-Range", "bytes 0-0/4096")
+			w.WriteHeader(http.StatusPartialContent)
+			w.Write([]byte("x"))
+		}, 4096, nil},
+		{"range ignored", func(w http.ResponseWriter, r *http.Request) {
+			if r.Method == "HEAD" {
+				w.WriteHeader(http.StatusMethodNotAllowed)
+				return
+			}
+			w.Header().Set("Content-Length", "4096")
+			w.Write([]byte(body))
+		}, 4096, nil},
+		{"no content range", func(w http.ResponseWriter, r *http.Request) {
+			if r.Method == "HEAD" {
+				w.WriteHeader(http.StatusMethodNotAllowed)
+				return
+			}
+			w.WriteHeader(http.StatusPartialContent)
+		}, 0, errProbeFailed},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			srv := httptest.NewServer(c.handler)
+			defer srv.Close()
+			probe, err := probeMedia(srv.URL+"/1.mp3", newHTTPIdentity(HTTPConfig{}))
+			if err != c.err || probe.Length != c.length {
+				t.Errorf("length %d error %v, want %d %v", probe.Length, err, c.length, c.err)
+			}
+		})
+	}
+}
@@ -0,0 +1,80 @@
+package platform
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"go.uber.org/zap"
+)
+
+// Fetcher is implemented by every provider
+type Fetcher interface {
+	Start() error
+}
+
+// fetchOptions are provider switches not coming from cli
+type fetchOptions struct {
+	fetchAll  bool
+	offline   bool
+	transport http.RoundTripper // replaces the archiving transport when set
+}
+
+// sourceOfURL guesses provider source from an album url
+func sourceOfURL(url string) string {
+	if strings.Contains(url, "ximalaya.com") {
+		return himalayaSource
+	} else if strings.Contains(url, "lizhi.fm") {
+		return litchiSource
+	}
+	return ""
+}
+
+// refreshMedia asks provider for fresh media urls of item and saves them, for
+// providers whose urls expire
+func refreshMedia(item PodcastItem, meta PodcastMeta, db *DB, cfg *Config, log *zap.SugaredLogger) (PodcastItem, error) {
+	switch meta.Source {
+	case himalayaSource:
+		h := NewHimalaya(meta.Link, meta.Provider, log, db).WithConfig(cfg)
+		id, _ := strconv.Atoi(item.ID)
+		src, err := h.fetchTrackAudio(id)
+		if err != nil {
+			return item, err
+		}
+		variants, err := h.fetchTrackMedia(id, src)
+		if err != nil {
+			log.Warnw("can't fetch other qualities of track, only standard one is kept", "track", id, "error", err)
+		}
+		item.Src, item.Variants = src, variants
+	default:
+		return item, fmt.Errorf("media urls of %s can't be refreshed", meta.Source)
+	}
+	log.Infow("refreshed media url", "id", item.ID, "title", item.Title)
+	return item, db.SaveItem(item)
+}
+
+// newFetcher builds provider of meta.Source, meta only needs Source, Provider and Link
+func newFetcher(meta PodcastMeta, opts fetchOptions, db *DB, cfg *Config, log *zap.SugaredLogger) (Fetcher, error) {
+	switch meta.Source {
+	case himalayaSource:
+		h := NewHimalaya(meta.Link, meta.Provider, log, db).WithConfig(cfg).FetchAll(opts.fetchAll)
+		if opts.offline {
+			h.Offline()
+		}
+		if opts.transport != nil {
+			h.client.Transport = opts.transport
+		}
+		return h, nil
+	case litchiSource:
+		l := NewLitchi(meta.Link, meta.Provider, log, db).WithConfig(cfg).FetchAll(opts.fetchAll)
+		if opts.offline {
+			l.Offline()
+		}
+		if opts.transport != nil {
+			l.client.Transport = opts.transport
+		}
+		return l, nil
+	}
+	return nil, fmt.Errorf("don't know provider of %s", meta.Link)
+}
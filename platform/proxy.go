@@ -0,0 +1,338 @@
+package platform
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ProxyConfig is the media proxy of the built-in server
+type ProxyConfig struct {
+	CacheDir  string // proxied media is cached here, no cache when empty
+	CacheSize int64  // bytes, least recently used files are evicted beyond it, 0 is unlimited
+}
+
+// ProxyURL returns where the built-in server proxies media of item, empty when
+// BaseURL isn't set
+func (c *Config) ProxyURL(item PodcastItem, v MediaVariant) string {
+	if c == nil || c.BaseURL == "" {
+		return ""
+	}
+	return fmt.Sprintf("%s/proxy/%s", strings.TrimRight(c.BaseURL, "/"), proxyName(item.ID, v))
+}
+
+// proxyName names variant v of item id under /proxy/ and in the cache,
+// <item id>.<quality>.<ext>, or <item id>.<ext> when v has no quality
+func proxyName(id string, v MediaVariant) string {
+	if v.Quality == "" {
+		return id + "." + v.ext()
+	}
+	return fmt.Sprintf("%s.%s.%s", id, v.Quality, v.ext())
+}
+
+// parseProxyName splits a name made by proxyName, item ids have no dots
+func parseProxyName(name string) (id, quality, ext string) {
+	ext = path.Ext(name)
+	id = strings.TrimSuffix(name, ext)
+	if i := strings.Index(id, "."); i >= 0 {
+		id, quality = id[:i], id[i+1:]
+	}
+	return id, quality, strings.TrimPrefix(ext, ".")
+}
+
+// proxyVariant is the variant of item a proxy name asks for, the preferred
+// one of prefs when it's gone or the name has no quality
+func proxyVariant(item PodcastItem, quality, ext string, prefs []string) MediaVariant {
+	for _, v := range item.Variants {
+		if quality != "" && v.Quality == quality && v.ext() == ext && v.URL != "" {
+			return v
+		}
+	}
+	return chooseVariant(item, prefs)
+}
+
+// errDBBusy is when a fetch holds the database for now
+var errDBBusy = errors.New("database is busy")
+
+// proxyTarget is where and how media of an item is requested
+type proxyTarget struct {
+	id     string
+	url    string
+	name   string // proxyName of the chosen variant, its key in cache
+	source string
+	http   HTTPConfig
+}
+
+// WithProxy enables /proxy/<item id>.<quality>.<ext>. The database is opened by open
+// only for the time of a lookup, so fetches can run while serving
+func (s *Server) WithProxy(open func() (*DB, error)) *Server {
+	s.open = open
+	if s.cfg != nil && s.cfg.Proxy.CacheDir != "" {
+		s.cache = &mediaCache{dir: s.cfg.Proxy.CacheDir, size: s.cfg.Proxy.CacheSize, filling: map[string]bool{}}
+	}
+	return s
+}
+
+// lookup finds media url of the variant name asks for, refresh asks provider for a fresh one
+func (s *Server) lookup(name string, refresh bool) (proxyTarget, error) {
+	id, quality, ext := parseProxyName(name)
+	s.dbMu.Lock()
+	defer s.dbMu.Unlock()
+	db, err := s.open()
+	if err != nil {
+		return proxyTarget{}, fmt.Errorf("%w: %v", errDBBusy, err)
+	}
+	defer db.Close()
+
+	item, err := db.FindPodcastItem(id)
+	if err != nil {
+		return proxyTarget{}, ErrNotFound
+	}
+	meta, err := db.FindPodcastMeta(item.AlbumID)
+	if err != nil {
+		return proxyTarget{}, ErrNotFound
+	}
+	if meta.Source == "" {
+		meta.Source = sourceOfURL(meta.Link)
+	}
+	if refresh {
+		if item, err = refreshMedia(item, meta, db, s.cfg, s.log); err != nil {
+			return proxyTarget{}, err
+		}
+	}
+	v := proxyVariant(item, quality, ext, s.cfg.Feed(item.AlbumID).Quality)
+	if v.URL == "" {
+		return proxyTarget{}, ErrPaidContent
+	}
+	return proxyTarget{id: id, url: v.URL, name: proxyName(id, v), source: meta.Source, http: s.cfg.Identity(meta.Source, item.AlbumID)}, nil
+}
+
+// upstream requests media of t, forwarding range and conditional headers of r
+func (s *Server) upstream(ctx context.Context, r *http.Request, t proxyTarget) (*http.Response, error) {
+	identity := newHTTPIdentity(t.http)
+	req, err := identity.mediaRequest(ctx, r.Method, t.url, t.source)
+	if err != nil {
+		return nil, err
+	}
+	for _, h := range []string{"Range", "If-Range", "If-Modified-Since", "If-None-Match"} {
+		if v := r.Header.Get(h); v != "" {
+			req.Header.Set(h, v)
+		}
+	}
+	// no timeout, a stream lasts as long as the listener wants
+	client := &http.Client{Transport: identity.transport(http.DefaultTransport)}
+	return client.Do(req)
+}
+
+// urlExpired if the cdn answer means a signed or temporary url is no longer valid
+func urlExpired(status int) bool {
+	return status == http.StatusForbidden || status == http.StatusNotFound || status == http.StatusGone
+}
+
+func (s *Server) proxy(w http.ResponseWriter, r *http.Request, name string) {
+	if s.open == nil {
+		http.NotFound(w, r)
+		return
+	}
+	id, _, _ := parseProxyName(name)
+	if s.cache != nil && s.cache.serve(w, r, name) {
+		return
+	}
+	t, err := s.lookup(name, false)
+	if err != nil {
+		s.proxyError(w, id, err)
+		return
+	}
+	resp, err := s.upstream(r.Context(), r, t)
+	if err == nil && urlExpired(resp.StatusCode) {
+		resp.Body.Close()
+		s.log.Infow("media url expired, asking provider for a fresh one", "id", id, "status", resp.StatusCode)
+		if t, err = s.lookup(name, true); err == nil {
+			resp, err = s.upstream(r.Context(), r, t)
+		}
+	}
+	if err != nil {
+		s.proxyError(w, id, err)
+		return
+	}
+	defer resp.Body.Close()
+
+	for _, h := range []string{"Content-Type", "Content-Length", "Content-Range", "Accept-Ranges", "Last-Modified", "ETag"} {
+		if v := resp.Header.Get(h); v != "" {
+			w.Header().Set(h, v)
+		}
+	}
+	if t := mimeTypeOfFile(name); t != "" && mimeType(resp.Header.Get("Content-Type")) == "" {
+		// some cdns say octet-stream
+		w.Header().Set("Content-Type", t)
+	}
+	w.WriteHeader(resp.StatusCode)
+	io.Copy(w, resp.Body)
+
+	if s.cache != nil && r.Method == "GET" && (resp.StatusCode == http.StatusOK || resp.StatusCode == http.StatusPartialContent) {
+		go s.cache.fill(t, s)
+	}
+}
+
+func (s *Server) proxyError(w http.ResponseWriter, id string, err error) {
+	s.log.Warnw("proxy failed", "id", id, "error", err)
+	switch {
+	case errors.Is(err, errDBBusy):
+		w.Header().Set("Retry-After", "2")
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+	case errors.Is(err, ErrNotFound):
+		http.Error(w, "no such item", http.StatusNotFound)
+	case errors.Is(err, ErrPaidContent):
+		http.Error(w, err.Error(), http.StatusPaymentRequired)
+	default:
+		http.Error(w, err.Error(), http.StatusBadGateway)
+	}
+}
+
+// mediaCache keeps whole media files of proxied items, files are touched when
+// served so their mtime tells which are least recently used
+type mediaCache struct {
+	dir  string
+	size int64
+
+	mu      sync.Mutex
+	filling map[string]bool
+}
+
+// path of media cached as name, a proxyName, so a file cached for one variant
+// is never served for another
+func (c *mediaCache) path(name string) string {
+	return filepath.Join(c.dir, safeFileName(name))
+}
+
+// serve answers r from cache, false when name isn't cached
+func (c *mediaCache) serve(w http.ResponseWriter, r *http.Request, name string) bool {
+	p := c.path(name)
+	fp, err := os.Open(p)
+	if err != nil {
+		return false
+	}
+	defer fp.Close()
+	now := time.Now()
+	os.Chtimes(p, now, now)
+	if t := mimeTypeOfFile(name); t != "" {
+		w.Header().Set("Content-Type", t)
+	}
+	// mtime is the last use, not a modification of content
+	http.ServeContent(w, r, name, time.Time{}, fp)
+	return true
+}
+
+// fill downloads whole media of t into cache, once per item at a time
+func (c *mediaCache) fill(t proxyTarget, s *Server) {
+	c.mu.Lock()
+	if c.filling[t.id] {
+		c.mu.Unlock()
+		return
+	}
+	c.filling[t.id] = true
+	c.mu.Unlock()
+	defer func() {
+		c.mu.Lock()
+		delete(c.filling, t.id)
+		c.mu.Unlock()
+	}()
+	if _, err := os.Stat(c.path(t.name)); err == nil {
+		return
+	}
+
+	identity := newHTTPIdentity(t.http)
+	req, err := identity.mediaRequest(context.Background(), "GET", t.url, t.source)
+	if err != nil {
+		return
+	}
+	resp, err := (&http.Client{Transport: identity.transport(http.DefaultTransport)}).Do(req)
+	if err != nil {
+		s.log.Warnw("caching media failed", "id", t.id, "error", err)
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		s.log.Warnw("caching media failed", "id", t.id, "status", resp.StatusCode)
+		return
+	}
+	if err := os.MkdirAll(c.dir, 0755); err != nil {
+		s.log.Error(err)
+		return
+	}
+	tmp, err := ioutil.TempFile(c.dir, ".fill-")
+	if err != nil {
+		s.log.Error(err)
+		return
+	}
+	_, err = io.Copy(tmp, resp.Body)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), c.path(t.name))
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		s.log.Warnw("caching media failed", "id", t.id, "error", err)
+		return
+	}
+	s.log.Debugw("cached media", "id", t.id, "name", t.name)
+	c.dropStale(t.id, t.name)
+	c.evict()
+}
+
+// dropStale removes files of id cached for a variant other than name, the
+// quality or format of feed changed since and they would never be served
+func (c *mediaCache) dropStale(id, name string) {
+	entries, err := ioutil.ReadDir(c.dir)
+	if err != nil {
+		return
+	}
+	keep := filepath.Base(c.path(name))
+	prefix := safeFileName(id) + "."
+	for _, fi := range entries {
+		if fi.Name() != keep && strings.HasPrefix(fi.Name(), prefix) {
+			os.Remove(filepath.Join(c.dir, fi.Name()))
+		}
+	}
+}
+
+// evict removes least recently used files until cache fits its size
+func (c *mediaCache) evict() {
+	if c.size <= 0 {
+		return
+	}
+	entries, err := ioutil.ReadDir(c.dir)
+	if err != nil {
+		return
+	}
+	var files []os.FileInfo
+	var total int64
+	for _, fi := range entries {
+		if fi.IsDir() || strings.HasPrefix(fi.Name(), ".fill-") {
+			continue
+		}
+		files = append(files, fi)
+		total += fi.Size()
+	}
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].ModTime().Before(files[j].ModTime())
+	})
+	// the newest file stays even when it alone is over size
+	for i := 0; total > c.size && i < len(files)-1; i++ {
+		if os.Remove(filepath.Join(c.dir, files[i].Name())) == nil {
+			total -= files[i].Size()
+		}
+	}
+}
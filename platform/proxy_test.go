@@ -0,0 +1,121 @@
+package platform
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/asdine/storm"
+	"github.com/dracher/podcast_fetcher/fakeprovider"
+	"go.uber.org/zap"
+)
+
+// waitFile waits for the cache filled in background, false when path isn't there in time
+func waitFile(path string, exists bool) bool {
+	for i := 0; i < 100; i++ {
+		if _, err := os.Stat(path); (err == nil) == exists {
+			return true
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	return false
+}
+
+func TestProxyCacheVariants(t *testing.T) {
+	fakeProvider(t, fakeprovider.New(fakeprovider.Options{}))
+	log := zap.NewNop().Sugar()
+	dbPath := filepath.Join(t.TempDir(), "podcasts.db")
+	open := func() (*DB, error) {
+		s, err := storm.Open(dbPath)
+		if err != nil {
+			return nil, err
+		}
+		return NewDB(s, log), nil
+	}
+	db, err := open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := &Config{FeedDir: t.TempDir(), BaseURL: "http://localhost:8080", Proxy: ProxyConfig{CacheDir: t.TempDir()}, Feeds: map[string]FeedConfig{}}
+	err = NewHimalaya("https://www.ximalaya.com/yingshi/1000/", "喜马拉雅", log, db).WithConfig(cfg).Start()
+	db.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(NewServer(cfg, log).WithProxy(open))
+	defer srv.Close()
+
+	get := func(name string) string {
+		t.Helper()
+		resp, err := http.Get(srv.URL + "/proxy/" + name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, _ := ioutil.ReadAll(resp.Body)
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("%s: status %d", name, resp.StatusCode)
+		}
+		return string(body)
+	}
+	cached := func(name string) string { return filepath.Join(cfg.Proxy.CacheDir, name) }
+
+	// feed switches between variants, even of the same format, a file cached
+	// for one is never served for another and goes away
+	steps := []struct {
+		quality, name, body string
+	}{
+		{"mp3:64k", "10000001.64k.mp3", "1000-1_64;"},
+		{"mp3:32k", "10000001.32k.mp3", "1000-1_32;"},
+		{"m4a:24k", "10000001.24k.m4a", "1000-1_24;"},
+	}
+	for n, step := range steps {
+		cfg.Feeds["1000"] = FeedConfig{Quality: []string{step.quality}}
+		item := proxyItem(t, open, "10000001")
+		if name := path.Base(proxyURL(cfg, item)); name != step.name {
+			t.Fatalf("%s: enclosure is %s, want %s", step.quality, name, step.name)
+		}
+		if body := get(step.name); !strings.Contains(body, step.body) {
+			t.Errorf("%s: served another variant", step.name)
+		}
+		if !waitFile(cached(step.name), true) {
+			t.Fatalf("%s isn't cached", step.name)
+		}
+		if n > 0 && !waitFile(cached(steps[n-1].name), false) {
+			t.Errorf("%s of the old variant is still cached", steps[n-1].name)
+		}
+		if body := get(step.name); !strings.Contains(body, step.body) {
+			t.Errorf("cached %s isn't served", step.name)
+		}
+	}
+	// names without a quality, of feeds written before, get the preferred variant
+	if body := get("10000001.m4a"); !strings.Contains(body, "1000-1_24;") {
+		t.Error("name without quality isn't served the preferred variant")
+	}
+}
+
+// proxyItem reads item id while the server doesn't hold the database
+func proxyItem(t *testing.T, open func() (*DB, error), id string) PodcastItem {
+	t.Helper()
+	db, err := open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	item, err := db.FindPodcastItem(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return item
+}
+
+// proxyURL is the enclosure feed of item has with ProxyEnclosures
+func proxyURL(cfg *Config, item PodcastItem) string {
+	return cfg.ProxyURL(item, chooseVariant(item, cfg.Feed(item.AlbumID).Quality))
+}
@@ -0,0 +1,83 @@
+package platform
+
+import (
+	"strings"
+)
+
+// MediaVariant is one quality/format of the audio of an item
+type MediaVariant struct {
+	Quality string // e.g.: high, low, 32k, 64k
+	Format  string // mp3 or m4a
+	Bitrate int    // bits per second, 0 when unknown
+	URL     string
+}
+
+// matches if preference is the quality, the format, or format:quality of variant
+func (v MediaVariant) matches(pref string) bool {
+	pref = strings.ToLower(pref)
+	return pref == v.Quality || pref == v.Format || pref == v.Format+":"+v.Quality
+}
+
+// MimeType is
+func (v MediaVariant) MimeType() string {
+	switch v.Format {
+	case "mp3":
+		return "audio/mpeg"
+	case "m4a":
+		return "audio/x-m4a"
+	}
+	return ""
+}
+
+// ext is file extension of variant, mp3 when unknown
+func (v MediaVariant) ext() string {
+	ext := v.Format
+	if ext == "" {
+		ext = formatOfURL(v.URL)
+	}
+	if ext == "" || len(ext) > 4 {
+		ext = "mp3"
+	}
+	return ext
+}
+
+// formatOfURL is the file extension of url, without query string
+func formatOfURL(url string) string {
+	if i := strings.Index(url, "?"); i >= 0 {
+		url = url[:i]
+	}
+	if i := strings.LastIndex(url, "."); i >= 0 && !strings.Contains(url[i:], "/") {
+		return strings.ToLower(url[i+1:])
+	}
+	return ""
+}
+
+// chooseVariant returns the first variant matching preferences in order,
+// falls back to the item Src as provider gives it
+func chooseVariant(item PodcastItem, prefs []string) MediaVariant {
+	for _, pref := range prefs {
+		for _, v := range item.Variants {
+			if v.URL != "" && v.matches(pref) {
+				return v
+			}
+		}
+	}
+	for _, v := range item.Variants {
+		if v.URL == item.Src {
+			return v
+		}
+	}
+	return MediaVariant{URL: item.Src, Format: formatOfURL(item.Src)}
+}
+
+// variantMedia returns length and mime type of variant v of item, from item
+// itself when v is its Src, otherwise from probe cache or guessed by format
+func variantMedia(item PodcastItem, v MediaVariant, db *DB) (int64, string) {
+	if v.URL == item.Src && (item.Length != 0 || item.MimeType != "") {
+		return item.Length, item.MimeType
+	}
+	if probe, err := db.FindMediaProbe(v.URL); err == nil {
+		return probe.Length, probe.MimeType
+	}
+	return 0, v.MimeType()
+}
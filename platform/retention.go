@@ -0,0 +1,189 @@
+package platform
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// retention rules of a feed, set by FeedConfig.Retention
+const (
+	RetainAll  = "all"  // the default, and the default of serial feeds like audiobooks
+	RetainLast = "last" // last:N keeps newest N items
+	RetainDays = "days" // days:D keeps items published in last D days
+)
+
+// parseRetention parses a rule, zero last and days keep everything
+func parseRetention(rule string) (last int, days int, err error) {
+	if rule == "" || rule == RetainAll {
+		return 0, 0, nil
+	}
+	parts := strings.SplitN(rule, ":", 2)
+	if len(parts) == 2 {
+		n, err := strconv.Atoi(parts[1])
+		switch {
+		case err != nil || n <= 0:
+		case parts[0] == RetainLast:
+			return n, 0, nil
+		case parts[0] == RetainDays:
+			return 0, n, nil
+		}
+	}
+	return 0, 0, fmt.Errorf("retention %q isn't all, last:N or days:D", rule)
+}
+
+// retention returns retention rule of podcast pid, serial podcasts keep
+// everything unless their feed says otherwise
+func (c *Config) retention(pid string, meta PodcastMeta) string {
+	if c == nil {
+		return RetainAll
+	}
+	f := c.Feeds[pid]
+	switch {
+	case f.Retention != "":
+		return f.Retention
+	case f.Type == "serial" || (f.Type == "" && meta.Serial):
+		return RetainAll
+	case c.Retention != "":
+		return c.Retention
+	}
+	return RetainAll
+}
+
+// itemsToPrune returns items rule doesn't keep, now is when days are counted from
+func itemsToPrune(items []PodcastItem, rule string, now time.Time) ([]PodcastItem, error) {
+	last, days, err := parseRetention(rule)
+	if err != nil || (last == 0 && days == 0) {
+		return nil, err
+	}
+	sortItems(items, false)
+	var ret []PodcastItem
+	for n, item := range items {
+		if (last > 0 && n >= last) || (days > 0 && item.PubDate.Before(now.AddDate(0, 0, -days))) {
+			ret = append(ret, item)
+		}
+	}
+	return ret, nil
+}
+
+// PrunedItem marks an item retention deleted, it's still on the latest pages
+// of provider and fetches mustn't store it again
+type PrunedItem struct {
+	ID        string `storm:"id"`
+	PodcastID string `storm:"index"`
+	Rule      string // retention which pruned it, another one may keep it
+	PrunedAt  time.Time
+}
+
+// forgetPruned lets items pruned by an earlier retention rule of meta be stored
+// again, the current one may keep them
+func forgetPruned(meta PodcastMeta, db *DB, cfg *Config) error {
+	return db.ForgetPrunedItems(meta.ID, cfg.retention(meta.ID, meta))
+}
+
+// PruneReport is what pruning a podcast deletes, or would delete on a dry run
+type PruneReport struct {
+	PodcastID string
+	Rule      string
+	Items     []PodcastItem // deleted from database
+	Files     []string      // deleted from archive, relative to it
+	Feed      string        // path of the feed left by items
+	InFeed    int           // items that were entries of the feed
+	Responses int           // archived provider responses of items
+	Runs      int           // run records older than the newest runsKept
+}
+
+// prune deletes items of podcast pid its retention doesn't keep, with their
+// archived media, responses and probes, and run history past runsKept. The
+// feed is left to the caller to regenerate
+func prune(pid string, db *DB, cfg *Config, dryRun bool, log *zap.SugaredLogger) (PruneReport, error) {
+	report := PruneReport{PodcastID: pid, Feed: cfg.FeedPath(pid)}
+	meta, err := db.FindPodcastMeta(pid)
+	if err != nil {
+		return report, err
+	}
+	items, err := db.FindPodcastItems(pid)
+	if err != nil {
+		return report, err
+	}
+	if meta.Source == "" {
+		meta.Source = sourceOfURL(meta.Link)
+	}
+	report.Rule = cfg.retention(pid, meta)
+	if report.Items, err = itemsToPrune(items, report.Rule, time.Now()); err != nil {
+		return report, err
+	}
+	report.InFeed = len(applyPaidPolicy(append([]PodcastItem(nil), report.Items...), cfg.Feed(pid).Paid))
+
+	dir := cfg.ArchivePath()
+	for _, item := range report.Items {
+		if item.LocalPath != "" {
+			if _, err := os.Stat(filepath.Join(dir, item.LocalPath)); err == nil {
+				report.Files = append(report.Files, item.LocalPath)
+			}
+		}
+		for _, url := range itemResponseURLs(meta, item) {
+			n, err := db.CountRawResponses(url)
+			if err != nil {
+				return report, err
+			}
+			report.Responses += n
+			if n > 0 && !dryRun {
+				if err := db.TrimRawResponses(url, 0); err != nil {
+					return report, err
+				}
+			}
+		}
+		if dryRun {
+			continue
+		}
+		if item.LocalPath != "" {
+			path := filepath.Join(dir, item.LocalPath)
+			if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+				return report, err
+			}
+			os.Remove(path + ".part")
+		}
+		db.DeleteMediaProbe(item.Src)
+		for _, v := range item.Variants {
+			db.DeleteMediaProbe(v.URL)
+		}
+		if err := db.DeleteItem(item); err != nil {
+			return report, err
+		}
+		if err := db.SavePrunedItem(PrunedItem{ID: item.ID, PodcastID: pid, Rule: report.Rule, PrunedAt: time.Now()}); err != nil {
+			return report, err
+		}
+	}
+
+	runs, err := db.FindOldRuns(pid, runsKept)
+	if err != nil {
+		return report, err
+	}
+	report.Runs = len(runs)
+	for n := 0; n < len(runs) && !dryRun; n++ {
+		if err := db.DeleteRun(runs[n]); err != nil {
+			return report, err
+		}
+	}
+	if (len(report.Items) > 0 || report.Runs > 0) && !dryRun {
+		log.Infow("pruned items", "id", pid, "retention", report.Rule, "items", len(report.Items), "files", len(report.Files),
+			"responses", report.Responses, "runs", report.Runs)
+	}
+	return report, nil
+}
+
+// Prune enforces retention of podcast pid and regenerates its feed, a dry run
+// only reports what would be deleted
+func Prune(pid string, db *DB, cfg *Config, dryRun bool, log *zap.SugaredLogger) (PruneReport, error) {
+	report, err := prune(pid, db, cfg, dryRun, log)
+	if err == nil && !dryRun && len(report.Items) > 0 {
+		ProduceRSSFeed(pid, db, cfg, log)
+	}
+	return report, err
+}
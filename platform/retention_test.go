@@ -0,0 +1,111 @@
+package platform
+
+import (
+	"testing"
+
+	"github.com/dracher/podcast_fetcher/fakeprovider"
+	"go.uber.org/zap"
+)
+
+func TestPruneResponsesAndRuns(t *testing.T) {
+	fakeProvider(t, fakeprovider.New(fakeprovider.Options{}))
+	log := zap.NewNop().Sugar()
+	db := newTestDB(t)
+	cfg := &Config{FeedDir: t.TempDir(), ArchiveDir: t.TempDir()}
+	if err := NewHimalaya("https://www.ximalaya.com/yingshi/1000/", "喜马拉雅", log, db).WithConfig(cfg).FetchAll(true).Start(); err != nil {
+		t.Fatal(err)
+	}
+	meta, _ := db.FindPodcastMeta("1000")
+	items, _ := db.FindPodcastItems("1000")
+	for n := 0; n < runsKept+5; n++ {
+		db.SaveRun(RunRecord{PodcastID: "1000", Source: himalayaSource})
+	}
+	responses := func(item PodcastItem) int {
+		total := 0
+		for _, url := range itemResponseURLs(meta, item) {
+			n, err := db.CountRawResponses(url)
+			if err != nil {
+				t.Fatal(err)
+			}
+			total += n
+		}
+		return total
+	}
+	for _, item := range items {
+		if responses(item) == 0 {
+			t.Fatalf("responses of track %s aren't archived", item.ID)
+		}
+	}
+
+	cfg.Feeds = map[string]FeedConfig{"1000": {Retention: "last:10"}}
+	dry, err := Prune("1000", db, cfg, true, log)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(dry.Items) != 65 || dry.Responses == 0 || dry.Runs != 6 {
+		t.Errorf("dry run would delete %d items, %d responses, %d runs", len(dry.Items), dry.Responses, dry.Runs)
+	}
+	report, err := Prune("1000", db, cfg, false, log)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Responses != dry.Responses || report.Runs != dry.Runs {
+		t.Errorf("deleted %d responses, %d runs, dry run said %d, %d", report.Responses, report.Runs, dry.Responses, dry.Runs)
+	}
+	for _, item := range report.Items {
+		if responses(item) != 0 {
+			t.Errorf("responses of pruned track %s are kept", item.ID)
+		}
+	}
+	kept, _ := db.FindPodcastItems("1000")
+	for _, item := range kept {
+		if responses(item) == 0 {
+			t.Errorf("responses of kept track %s are deleted", item.ID)
+		}
+	}
+	if runs, _ := db.FindRuns("1000", runsKept*2); len(runs) != runsKept {
+		t.Errorf("%d runs kept, want %d", len(runs), runsKept)
+	}
+}
+
+type testItems []PodcastItem
+
+func (t testItems) Items() []PodcastItem { return t }
+
+func TestPrunedItemsStayPruned(t *testing.T) {
+	fakeProvider(t, fakeprovider.New(fakeprovider.Options{}))
+	log := zap.NewNop().Sugar()
+	db := newTestDB(t)
+	cfg := &Config{FeedDir: t.TempDir(), Feeds: map[string]FeedConfig{"1000": {Retention: "last:10"}}}
+	fetch := func(all bool) {
+		t.Helper()
+		if err := NewHimalaya("https://www.ximalaya.com/yingshi/1000/", "喜马拉雅", log, db).WithConfig(cfg).FetchAll(all).Start(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	fetch(true)
+	items, _ := db.FindPodcastItems("1000")
+	if len(items) != 10 {
+		t.Fatalf("%d items kept, want 10", len(items))
+	}
+
+	// track 75 - 10 is on the latest page, a fetch gives it again
+	pruned := PodcastItem{ID: "10000065", AlbumID: "1000", Index: 65}
+	if err := db.SaveItems(testItems{pruned}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.FindPodcastItem(pruned.ID); err == nil {
+		t.Error("pruned item is stored again")
+	}
+	fetch(false)
+	if items, _ := db.FindPodcastItems("1000"); len(items) != 10 {
+		t.Errorf("%d items after latest fetch, want 10", len(items))
+	}
+
+	// a looser rule keeps them again
+	cfg.Feeds["1000"] = FeedConfig{Retention: "last:20"}
+	fetch(false)
+	if items, _ := db.FindPodcastItems("1000"); len(items) != 20 {
+		t.Errorf("%d items after rule changed, want 20", len(items))
+	}
+}
@@ -0,0 +1,255 @@
+package platform
+
+import (
+	"crypto/sha1"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// EndpointShape is the set of json paths seen from a provider endpoint on the
+// last successful run of a podcast in the same mode
+type EndpointShape struct {
+	Key         string `storm:"id"` // baseline and endpoint, e.g.: ximalaya/1000/full/ximalaya/album
+	Endpoint    string // e.g.: ximalaya/album
+	Fingerprint string
+	Paths       []string
+}
+
+// shapeBaseline is key prefix of shapes runs are compared with. Optional fields
+// differ between albums and pages, so only runs of the same podcast which asked
+// the same pages, all of them or the latest one, are compared
+func shapeBaseline(source, pid string, full bool) string {
+	mode := "latest"
+	if full {
+		mode = "full"
+	}
+	return fmt.Sprintf("%s/%s/%s/", source, pid, mode)
+}
+
+// shapeRecorder collects shapes of responses decoded during one run, in strict
+// mode it also reports fields we expect but don't get, and fields we don't know
+type shapeRecorder struct {
+	strict bool
+
+	mu       sync.Mutex
+	shapes   map[string]map[string]bool
+	warnings []string
+}
+
+func newShapeRecorder(strict bool) *shapeRecorder {
+	return &shapeRecorder{strict: strict, shapes: map[string]map[string]bool{}}
+}
+
+// decode unmarshals data into v and records its shape under endpoint, diagnostics
+// are returned as warnings, not errors, since decoding itself succeeded
+func (r *shapeRecorder) decode(endpoint string, data []byte, v interface{}) ([]string, error) {
+	if err := json.Unmarshal(data, v); err != nil {
+		return nil, err
+	}
+	var raw interface{}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return nil, err
+	}
+	got := map[string]bool{}
+	jsonPaths("", raw, got)
+
+	r.mu.Lock()
+	if r.shapes[endpoint] == nil {
+		r.shapes[endpoint] = map[string]bool{}
+	}
+	for p := range got {
+		r.shapes[endpoint][p] = true
+	}
+	r.mu.Unlock()
+
+	if !r.strict {
+		return nil, nil
+	}
+	warnings := diffShape(endpoint, expectedPaths(reflect.TypeOf(v)), got)
+	r.mu.Lock()
+	for _, w := range warnings {
+		if !containsString(r.warnings, w) {
+			r.warnings = append(r.warnings, w)
+		}
+	}
+	r.mu.Unlock()
+	return warnings, nil
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// endpointShapes returns shapes of this run, keyed under baseline
+func (r *shapeRecorder) endpointShapes(baseline string) []EndpointShape {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var ret []EndpointShape
+	for endpoint, set := range r.shapes {
+		var paths []string
+		for p := range set {
+			// a field null on one page and typed on another is the same field
+			if !strings.Contains(p, ":") && hasTypedPath(set, p) {
+				continue
+			}
+			paths = append(paths, p)
+		}
+		sort.Strings(paths)
+		ret = append(ret, EndpointShape{
+			Key:         baseline + endpoint,
+			Endpoint:    endpoint,
+			Fingerprint: fmt.Sprintf("%x", sha1.Sum([]byte(strings.Join(paths, "\n")))),
+			Paths:       paths,
+		})
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i].Endpoint < ret[j].Endpoint })
+	return ret
+}
+
+func hasTypedPath(set map[string]bool, p string) bool {
+	for _, t := range []string{"string", "number", "bool", "object", "array"} {
+		if set[p+":"+t] {
+			return true
+		}
+	}
+	return false
+}
+
+// jsonPaths flattens v into paths like data.tracks[].trackId:number, null values have no type
+func jsonPaths(prefix string, v interface{}, out map[string]bool) {
+	switch val := v.(type) {
+	case map[string]interface{}:
+		if prefix != "" {
+			out[prefix+":object"] = true
+		}
+		for k, child := range val {
+			p := k
+			if prefix != "" {
+				p = prefix + "." + k
+			}
+			jsonPaths(p, child, out)
+		}
+	case []interface{}:
+		out[prefix+":array"] = true
+		for _, child := range val {
+			jsonPaths(prefix+"[]", child, out)
+		}
+	case string:
+		out[prefix+":string"] = true
+	case float64:
+		out[prefix+":number"] = true
+	case bool:
+		out[prefix+":bool"] = true
+	case nil:
+		out[prefix] = true
+	}
+}
+
+// expectedPaths lists lower cased json paths a response struct decodes, matching
+// encoding/json which compares names case insensitively
+func expectedPaths(t reflect.Type) map[string]bool {
+	out := map[string]bool{}
+	var walk func(prefix string, t reflect.Type)
+	walk = func(prefix string, t reflect.Type) {
+		for t.Kind() == reflect.Ptr {
+			t = t.Elem()
+		}
+		switch t.Kind() {
+		case reflect.Struct:
+			for i := 0; i < t.NumField(); i++ {
+				f := t.Field(i)
+				if f.PkgPath != "" {
+					continue
+				}
+				name := f.Name
+				if tag := strings.Split(f.Tag.Get("json"), ",")[0]; tag == "-" {
+					continue
+				} else if tag != "" {
+					name = tag
+				}
+				p := strings.ToLower(name)
+				if prefix != "" {
+					p = prefix + "." + p
+				}
+				out[p] = true
+				walk(p, f.Type)
+			}
+		case reflect.Slice, reflect.Array:
+			out[prefix+"[]"] = true
+			walk(prefix+"[]", t.Elem())
+		}
+	}
+	walk("", t)
+	return out
+}
+
+func parentPath(p string) string {
+	if i := strings.LastIndex(p, "."); i >= 0 {
+		return p[:i]
+	}
+	return ""
+}
+
+// diffShape reports expected fields missing from got and the topmost unknown fields of got
+func diffShape(endpoint string, expected, got map[string]bool) []string {
+	seen := map[string]bool{}
+	for p := range got {
+		if i := strings.LastIndex(p, ":"); i >= 0 {
+			p = p[:i]
+		}
+		seen[strings.ToLower(p)] = true
+	}
+	var warnings []string
+	for p := range expected {
+		if !seen[p] && !strings.HasSuffix(p, "[]") && (parentPath(p) == "" || seen[parentPath(p)]) {
+			warnings = append(warnings, fmt.Sprintf("%s: missing field %s", endpoint, p))
+		}
+	}
+	for p := range seen {
+		if expected[p] || strings.HasSuffix(p, "[]") {
+			continue
+		}
+		if parent := parentPath(p); parent == "" || expected[parent] {
+			warnings = append(warnings, fmt.Sprintf("%s: unknown field %s", endpoint, p))
+		}
+	}
+	sort.Strings(warnings)
+	return warnings
+}
+
+// compareShapes reports endpoints whose shape differs from the last successful run
+func compareShapes(last map[string]EndpointShape, current []EndpointShape) []string {
+	var warnings []string
+	for _, shape := range current {
+		prev, ok := last[shape.Endpoint]
+		if !ok || prev.Fingerprint == shape.Fingerprint {
+			continue
+		}
+		before := map[string]bool{}
+		for _, p := range prev.Paths {
+			before[p] = true
+		}
+		after := map[string]bool{}
+		for _, p := range shape.Paths {
+			after[p] = true
+			if !before[p] {
+				warnings = append(warnings, fmt.Sprintf("%s: shape changed, new path %s", shape.Endpoint, p))
+			}
+		}
+		for _, p := range prev.Paths {
+			if !after[p] {
+				warnings = append(warnings, fmt.Sprintf("%s: shape changed, path gone %s", shape.Endpoint, p))
+			}
+		}
+	}
+	return warnings
+}
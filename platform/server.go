@@ -0,0 +1,124 @@
+package platform
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"go.uber.org/zap"
+)
+
+// Server serves generated feeds and archived media, at the paths feeds point
+// to when BaseURL is the address of this server:
+//
+//	/<podcast id>.xml
+//	/media/<source>/<album id>/<date>-<title>.<ext>
+//	/proxy/<item id>.<quality>.<ext>, see WithProxy
+//
+// feeds and media are plain files, so it doesn't keep the database busy
+type Server struct {
+	cfg *Config
+	log *zap.SugaredLogger
+
+	open  func() (*DB, error)
+	dbMu  sync.Mutex
+	cache *mediaCache
+}
+
+// NewServer is
+func NewServer(cfg *Config, log *zap.SugaredLogger) *Server {
+	return &Server{cfg: cfg, log: log}
+}
+
+// ServeHTTP is
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.log.Debugw("serving", "method", r.Method, "path", r.URL.Path, "range", r.Header.Get("Range"))
+	if r.Method != "GET" && r.Method != "HEAD" {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	// cleaned from root, so no way out of archive or feed dir
+	p := path.Clean("/" + r.URL.Path)
+	switch {
+	case strings.HasPrefix(p, "/media/"):
+		s.media(w, r, strings.TrimPrefix(p, "/media/"))
+	case strings.HasPrefix(p, "/proxy/") && path.Dir(p) == "/proxy":
+		s.proxy(w, r, path.Base(p))
+	case path.Dir(p) == "/" && path.Ext(p) == ".xml":
+		s.feed(w, r, strings.TrimSuffix(path.Base(p), ".xml"))
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (s *Server) feed(w http.ResponseWriter, r *http.Request, pid string) {
+	fp, err := os.Open(s.cfg.FeedPath(pid))
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	defer fp.Close()
+	fi, err := fp.Stat()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/rss+xml; charset=utf-8")
+	http.ServeContent(w, r, pid+".xml", fi.ModTime(), fp)
+}
+
+// media serves an archived file, ServeContent takes care of Range and Content-Length
+func (s *Server) media(w http.ResponseWriter, r *http.Request, rel string) {
+	fp, err := os.Open(filepath.Join(s.cfg.ArchivePath(), filepath.FromSlash(rel)))
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	defer fp.Close()
+	fi, err := fp.Stat()
+	if err != nil || fi.IsDir() {
+		http.NotFound(w, r)
+		return
+	}
+	if t := mimeTypeOfFile(rel); t != "" {
+		w.Header().Set("Content-Type", t)
+	}
+	http.ServeContent(w, r, fi.Name(), fi.ModTime(), fp)
+}
+
+// mimeTypeOfFile guesses media type by extension
+func mimeTypeOfFile(name string) string {
+	return MediaVariant{Format: strings.TrimPrefix(strings.ToLower(filepath.Ext(name)), ".")}.MimeType()
+}
+
+// MediaURL returns where the built-in server serves archived media of item,
+// empty when BaseURL isn't set
+func (c *Config) MediaURL(item PodcastItem) string {
+	if c == nil || c.BaseURL == "" || item.LocalPath == "" {
+		return ""
+	}
+	var parts []string
+	for _, part := range strings.Split(filepath.ToSlash(item.LocalPath), "/") {
+		parts = append(parts, url.PathEscape(part))
+	}
+	return fmt.Sprintf("%s/media/%s", strings.TrimRight(c.BaseURL, "/"), strings.Join(parts, "/"))
+}
+
+// localEnclosure returns url, length and type of the archived media of item
+// served by the built-in server, ok is false when it isn't archived
+func localEnclosure(item PodcastItem, cfg *Config) (uri string, length int64, mime string, ok bool) {
+	uri = cfg.MediaURL(item)
+	if uri == "" {
+		return "", 0, "", false
+	}
+	fi, err := os.Stat(filepath.Join(cfg.ArchivePath(), item.LocalPath))
+	if err != nil {
+		return "", 0, "", false
+	}
+	return uri, fi.Size(), mimeTypeOfFile(item.LocalPath), true
+}
@@ -0,0 +1,310 @@
+package platform
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/cookiejar"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Session is the logged in cookies of a provider account, imported from a
+// browser export and kept up to date with cookies the provider sets
+type Session struct {
+	Source     string `storm:"id"`
+	Cookies    []SessionCookie
+	ImportedAt time.Time
+	UpdatedAt  time.Time
+	Expired    bool // provider said the session isn't logged in anymore
+}
+
+// SessionCookie is
+type SessionCookie struct {
+	Name     string
+	Value    string
+	Domain   string
+	Path     string
+	HostOnly bool
+	Expires  time.Time // zero for session cookies
+	Secure   bool
+	HTTPOnly bool
+}
+
+func (c SessionCookie) key() string {
+	return strings.TrimPrefix(c.Domain, ".") + c.Path + ";" + c.Name
+}
+
+func (c SessionCookie) expired(now time.Time) bool {
+	return !c.Expires.IsZero() && c.Expires.Before(now)
+}
+
+// String never shows the value, cookies mustn't end up in logs
+func (c SessionCookie) String() string {
+	exp := "session"
+	if !c.Expires.IsZero() {
+		exp = c.Expires.Format(time.RFC3339)
+	}
+	return fmt.Sprintf("%s%s %s=<redacted> expires %s", c.Domain, c.Path, c.Name, exp)
+}
+
+// ParseCookies reads cookies from a netscape cookies.txt or a json export of a
+// browser extension, only cookies of domain are kept
+func ParseCookies(data []byte, domain string) ([]SessionCookie, error) {
+	var cookies []SessionCookie
+	var err error
+	if trimmed := bytes.TrimSpace(data); len(trimmed) != 0 && trimmed[0] == '[' {
+		cookies, err = parseJSONCookies(trimmed)
+	} else {
+		cookies, err = parseNetscapeCookies(data)
+	}
+	if err != nil {
+		return nil, err
+	}
+	var ret []SessionCookie
+	for _, c := range cookies {
+		d := strings.TrimPrefix(c.Domain, ".")
+		if d == domain || strings.HasSuffix(d, "."+domain) {
+			ret = append(ret, c)
+		}
+	}
+	if len(ret) == 0 {
+		return nil, fmt.Errorf("no cookies of %s found", domain)
+	}
+	return ret, nil
+}
+
+func parseNetscapeCookies(data []byte) ([]SessionCookie, error) {
+	var cookies []SessionCookie
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		httpOnly := false
+		if strings.HasPrefix(line, "#HttpOnly_") {
+			line = strings.TrimPrefix(line, "#HttpOnly_")
+			httpOnly = true
+		}
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Split(line, "\t")
+		if len(fields) != 7 {
+			return nil, fmt.Errorf("line %d of cookies.txt doesn't have 7 fields", n)
+		}
+		c := SessionCookie{
+			Domain:   fields[0],
+			HostOnly: !strings.EqualFold(fields[1], "TRUE"),
+			Path:     fields[2],
+			Secure:   strings.EqualFold(fields[3], "TRUE"),
+			Name:     fields[5],
+			Value:    fields[6],
+			HTTPOnly: httpOnly,
+		}
+		expires, err := strconv.ParseInt(fields[4], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("line %d of cookies.txt: bad expiry %q", n, fields[4])
+		}
+		if expires != 0 {
+			c.Expires = time.Unix(expires, 0)
+		}
+		cookies = append(cookies, c)
+	}
+	return cookies, scanner.Err()
+}
+
+// parseJSONCookies reads the export format of EditThisCookie and alike
+func parseJSONCookies(data []byte) ([]SessionCookie, error) {
+	var list []struct {
+		Name           string
+		Value          string
+		Domain         string
+		Path           string
+		HostOnly       bool
+		Secure         bool
+		HTTPOnly       bool
+		Session        bool
+		ExpirationDate float64
+	}
+	if err := json.Unmarshal(data, &list); err != nil {
+		return nil, err
+	}
+	var cookies []SessionCookie
+	for _, c := range list {
+		sc := SessionCookie{
+			Name:     c.Name,
+			Value:    c.Value,
+			Domain:   c.Domain,
+			Path:     c.Path,
+			HostOnly: c.HostOnly,
+			Secure:   c.Secure,
+			HTTPOnly: c.HTTPOnly,
+		}
+		if !c.Session && c.ExpirationDate != 0 {
+			sc.Expires = time.Unix(int64(c.ExpirationDate), 0)
+		}
+		if sc.Path == "" {
+			sc.Path = "/"
+		}
+		cookies = append(cookies, sc)
+	}
+	return cookies, nil
+}
+
+// ImportSession replaces session of source with cookies in file path
+func ImportSession(source, path string, db *DB) (Session, error) {
+	domain, ok := sessionDomains[source]
+	if !ok {
+		return Session{}, fmt.Errorf("unknown provider %s", source)
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return Session{}, err
+	}
+	cookies, err := ParseCookies(data, domain)
+	if err != nil {
+		return Session{}, err
+	}
+	now := time.Now()
+	s := Session{Source: source, Cookies: cookies, ImportedAt: now, UpdatedAt: now}
+	return s, db.SaveSession(s)
+}
+
+// sessionDomains are the cookie domains of each provider
+var sessionDomains = map[string]string{
+	himalayaSource: "ximalaya.com",
+	litchiSource:   "lizhi.fm",
+}
+
+// sessionJar is a cookie jar seeded from the stored session, cookies set by the
+// provider are written back so refreshed tokens survive between runs
+type sessionJar struct {
+	db  *DB
+	jar *cookiejar.Jar
+
+	mu      sync.Mutex
+	session Session
+}
+
+// newSessionJar returns nil when source has no stored session
+func newSessionJar(db *DB, source string) *sessionJar {
+	session, err := db.FindSession(source)
+	if err != nil || len(session.Cookies) == 0 {
+		return nil
+	}
+	jar, _ := cookiejar.New(nil)
+	now := time.Now()
+	for _, c := range session.Cookies {
+		if c.expired(now) {
+			continue
+		}
+		u := &url.URL{Scheme: "https", Host: strings.TrimPrefix(c.Domain, "."), Path: c.Path}
+		hc := &http.Cookie{Name: c.Name, Value: c.Value, Path: c.Path, Expires: c.Expires, Secure: c.Secure, HttpOnly: c.HTTPOnly}
+		if !c.HostOnly {
+			hc.Domain = c.Domain
+		}
+		jar.SetCookies(u, []*http.Cookie{hc})
+	}
+	return &sessionJar{db: db, jar: jar, session: session}
+}
+
+// SetCookies is
+func (j *sessionJar) SetCookies(u *url.URL, cookies []*http.Cookie) {
+	j.jar.SetCookies(u, cookies)
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	now := time.Now()
+	stored := map[string]int{}
+	for i, c := range j.session.Cookies {
+		stored[c.key()] = i
+	}
+	for _, c := range cookies {
+		sc := SessionCookie{Name: c.Name, Value: c.Value, Domain: c.Domain, Path: c.Path, Secure: c.Secure, HTTPOnly: c.HttpOnly}
+		if sc.Domain == "" {
+			sc.Domain, sc.HostOnly = u.Hostname(), true
+		}
+		if sc.Path == "" {
+			sc.Path = "/"
+		}
+		switch {
+		case c.MaxAge > 0:
+			sc.Expires = now.Add(time.Duration(c.MaxAge) * time.Second)
+		case c.MaxAge < 0:
+			sc.Expires = now.Add(-time.Second)
+		default:
+			sc.Expires = c.Expires
+		}
+		if i, ok := stored[sc.key()]; ok {
+			j.session.Cookies[i] = sc
+		} else {
+			stored[sc.key()] = len(j.session.Cookies)
+			j.session.Cookies = append(j.session.Cookies, sc)
+		}
+	}
+	var kept []SessionCookie
+	for _, c := range j.session.Cookies {
+		if !c.expired(now) {
+			kept = append(kept, c)
+		}
+	}
+	j.session.Cookies = kept
+	j.session.UpdatedAt = now
+	j.db.SaveSession(j.session)
+}
+
+// Cookies is
+func (j *sessionJar) Cookies(u *url.URL) []*http.Cookie {
+	return j.jar.Cookies(u)
+}
+
+// expired if provider refused the session before or every cookie is past its expiry
+func (j *sessionJar) expired() bool {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.session.Expired {
+		return true
+	}
+	now := time.Now()
+	for _, c := range j.session.Cookies {
+		if !c.expired(now) {
+			return false
+		}
+	}
+	return true
+}
+
+// markExpired records that provider doesn't accept the session anymore
+func (j *sessionJar) markExpired() {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.session.Expired = true
+	j.db.SaveSession(j.session)
+}
+
+// session returns jar of the stored session when it's still usable, warns when it expired
+func (p *Podcast) session() *sessionJar {
+	jar, ok := p.client.Jar.(*sessionJar)
+	if !ok || p.offline {
+		return nil
+	}
+	if jar.expired() {
+		p.warn(fmt.Sprintf("%s session expired, import cookies again to fetch member content", p.meta.Source))
+		// the provider would refuse its cookies again, go as a guest
+		p.client.Jar = nil
+		return nil
+	}
+	return jar
+}
+
+// redactHeader returns a copy of response header without cookies, for anything written to disk
+func redactHeader(h http.Header) http.Header {
+	h = h.Clone()
+	h.Del("Set-Cookie")
+	return h
+}
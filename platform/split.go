@@ -0,0 +1,141 @@
+package platform
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// SplitConfig is a feed made of part of the items of one stored podcast, e.g.
+// weekend programs of an album mixing them with weekday ones. Every rule set
+// must match, title and cover of the feed are set by its key in Feeds
+type SplitConfig struct {
+	Podcast string // id of the stored podcast
+	Title   string // regexp of item titles
+	// From and To are the range of Index of items, 1 is the oldest, 0 is open
+	From int
+	To   int
+	// Every and Offset keep items whose Index % Every is Offset, e.g. every
+	// other track
+	Every  int
+	Offset int
+	// Weekdays are days items are published on in China time, e.g. ["sat", "sun"]
+	Weekdays []string
+}
+
+// chinaTime is where providers publish
+var chinaTime = time.FixedZone("CST", 8*60*60)
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday, "mon": time.Monday, "tue": time.Tuesday, "wed": time.Wednesday,
+	"thu": time.Thursday, "fri": time.Friday, "sat": time.Saturday,
+}
+
+type splitRule struct {
+	SplitConfig
+	title    *regexp.Regexp
+	weekdays map[time.Weekday]bool
+}
+
+func (c SplitConfig) compile() (splitRule, error) {
+	r := splitRule{SplitConfig: c}
+	if c.Podcast == "" {
+		return r, errors.New("split feed has no podcast")
+	}
+	if c.Title != "" {
+		var err error
+		if r.title, err = regexp.Compile(c.Title); err != nil {
+			return r, fmt.Errorf("title rule: %v", err)
+		}
+	}
+	if c.From < 0 || c.To < 0 || (c.To > 0 && c.To < c.From) {
+		return r, fmt.Errorf("index range %d-%d is empty", c.From, c.To)
+	}
+	if c.Every < 0 || (c.Every > 0 && (c.Offset < 0 || c.Offset >= c.Every)) || (c.Every == 0 && c.Offset != 0) {
+		return r, fmt.Errorf("offset %d isn't between 0 and every %d", c.Offset, c.Every)
+	}
+	if len(c.Weekdays) > 0 {
+		r.weekdays = map[time.Weekday]bool{}
+		for _, d := range c.Weekdays {
+			wd, ok := weekdays[strings.ToLower(d)]
+			if !ok {
+				return r, fmt.Errorf("weekday %q isn't one of mon, tue, wed, thu, fri, sat, sun", d)
+			}
+			r.weekdays[wd] = true
+		}
+	}
+	return r, nil
+}
+
+func (r splitRule) matches(item PodcastItem) bool {
+	switch {
+	case r.title != nil && !r.title.MatchString(item.Title):
+	case r.From > 0 && item.Index < r.From:
+	case r.To > 0 && item.Index > r.To:
+	case r.Every > 0 && item.Index%r.Every != r.Offset:
+	case r.weekdays != nil && !r.weekdays[item.PubDate.In(chinaTime).Weekday()]:
+	default:
+		return true
+	}
+	return false
+}
+
+// splitsOf returns ids of split feeds of podcast pid
+func (c *Config) splitsOf(pid string) []string {
+	if c == nil {
+		return nil
+	}
+	var ids []string
+	for id, split := range c.Splits {
+		if split.Podcast == pid {
+			ids = append(ids, id)
+		}
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// ProduceSplitFeed generates split feed id from stored items of its podcast
+func ProduceSplitFeed(id string, db *DB, cfg *Config, log *zap.SugaredLogger) error {
+	split, ok := cfg.Splits[id]
+	if !ok {
+		return fmt.Errorf("no split feed %s: %w", id, ErrNotFound)
+	}
+	rule, err := split.compile()
+	if err != nil {
+		return err
+	}
+	stored, err := storedPodcasts(db)
+	if err != nil {
+		return err
+	}
+	if stored[id] {
+		return fmt.Errorf("split feed %s has the id of a podcast, their feeds would overwrite each other", id)
+	}
+	if !stored[split.Podcast] {
+		return fmt.Errorf("podcast %s of split feed %s isn't stored: %w", split.Podcast, id, ErrNotFound)
+	}
+	meta, err := db.FindPodcastMeta(split.Podcast)
+	if err != nil {
+		return err
+	}
+	items, err := db.FindPodcastItems(split.Podcast)
+	if err != nil {
+		return err
+	}
+	src := feedSource{meta: meta, guid: derivedFeedGUID(id, cfg)}
+	src.meta.ID = id
+	for _, item := range items {
+		if rule.matches(item) {
+			src.items = append(src.items, item)
+		}
+	}
+	log.Infow("making split feed", "id", id, "podcast", split.Podcast, "items", len(src.items), "of", len(items))
+	writeFeed(id, src, db, cfg, log)
+	return nil
+}
@@ -0,0 +1,95 @@
+package platform
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/dracher/podcast_fetcher/fakeprovider"
+	"go.uber.org/zap"
+)
+
+func TestSplitRules(t *testing.T) {
+	// item n is published n days after a monday, 16:00 in China time
+	monday := time.Date(2018, 1, 1, 8, 0, 0, 0, time.UTC)
+	var items []PodcastItem
+	for n := 1; n <= 14; n++ {
+		items = append(items, PodcastItem{ID: fmt.Sprint(n), Index: n, Title: fmt.Sprintf("新闻 第%d期", n), PubDate: monday.AddDate(0, 0, n)})
+	}
+	cases := []struct {
+		split SplitConfig
+		want  string
+	}{
+		{SplitConfig{Podcast: "1000"}, "[1 2 3 4 5 6 7 8 9 10 11 12 13 14]"},
+		{SplitConfig{Podcast: "1000", Title: `第1\d期`}, "[10 11 12 13 14]"},
+		{SplitConfig{Podcast: "1000", From: 3, To: 5}, "[3 4 5]"},
+		{SplitConfig{Podcast: "1000", From: 12}, "[12 13 14]"},
+		{SplitConfig{Podcast: "1000", Every: 2, Offset: 1}, "[1 3 5 7 9 11 13]"},
+		{SplitConfig{Podcast: "1000", Weekdays: []string{"Sat", "sun"}}, "[5 6 12 13]"},
+		{SplitConfig{Podcast: "1000", From: 6, Weekdays: []string{"sat", "sun"}}, "[6 12 13]"},
+	}
+	for _, c := range cases {
+		rule, err := c.split.compile()
+		if err != nil {
+			t.Errorf("%+v: %v", c.split, err)
+			continue
+		}
+		var got []string
+		for _, item := range items {
+			if rule.matches(item) {
+				got = append(got, item.ID)
+			}
+		}
+		if fmt.Sprint(got) != c.want {
+			t.Errorf("%+v keeps %v, want %s", c.split, got, c.want)
+		}
+	}
+
+	broken := []SplitConfig{
+		{Title: "第"},
+		{Podcast: "1000", Title: "(第"},
+		{Podcast: "1000", From: 5, To: 3},
+		{Podcast: "1000", From: -1},
+		{Podcast: "1000", Every: 2, Offset: 2},
+		{Podcast: "1000", Offset: 1},
+		{Podcast: "1000", Weekdays: []string{"weekend"}},
+	}
+	for _, split := range broken {
+		if _, err := split.compile(); err == nil {
+			t.Errorf("%+v compiles", split)
+		}
+	}
+}
+
+func TestProduceSplitFeed(t *testing.T) {
+	fakeProvider(t, fakeprovider.New(fakeprovider.Options{}))
+	log := zap.NewNop().Sugar()
+	db := newTestDB(t)
+	cfg := &Config{FeedDir: t.TempDir(), Splits: map[string]SplitConfig{
+		"1000-weekend": {Podcast: "1000", To: 14, Weekdays: []string{"sat", "sun"}},
+	}}
+	if err := NewHimalaya("https://www.ximalaya.com/yingshi/1000/", "喜马拉雅", log, db).WithConfig(cfg).FetchAll(true).Start(); err != nil {
+		t.Fatal(err)
+	}
+	if err := ProduceSplitFeed("1000-weekend", db, cfg, log); err != nil {
+		t.Fatal(err)
+	}
+	feed := fetchFeed(t, cfg, "1000-weekend")
+	var got []string
+	for _, item := range feed.Channel.Items {
+		got = append(got, item.Title)
+	}
+	want := "[每日新闻 第13集 每日新闻 第12集 每日新闻 第6集 每日新闻 第5集]"
+	if fmt.Sprint(got) != want {
+		t.Errorf("split feed has %v, want %s", got, want)
+	}
+
+	cfg.Splits["1000"] = SplitConfig{Podcast: "1000"}
+	if err := ProduceSplitFeed("1000", db, cfg, log); err == nil {
+		t.Error("split feed with the id of a podcast is written")
+	}
+	cfg.Splits["missing"] = SplitConfig{Podcast: "9999"}
+	if err := ProduceSplitFeed("missing", db, cfg, log); err == nil {
+		t.Error("split feed of a podcast which isn't stored is written")
+	}
+}
@@ -0,0 +1,166 @@
+package platform
+
+import (
+	"context"
+	"fmt"
+	"html"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Tags are the metadata written into downloaded media
+type Tags struct {
+	Title       string
+	Album       string
+	Artist      string
+	Date        time.Time
+	Track       int
+	Description string
+	Cover       []byte
+	CoverMime   string // image/jpeg or image/png
+}
+
+// String is a summary for humans, without cover data
+func (t Tags) String() string {
+	date := ""
+	if !t.Date.IsZero() {
+		date = t.Date.Format("2006-01-02")
+	}
+	return fmt.Sprintf("title: %s\nalbum: %s\nartist: %s\ndate: %s\ntrack: %d\ndescription: %s\ncover: %s %d bytes",
+		t.Title, t.Album, t.Artist, date, t.Track, t.Description, t.CoverMime, len(t.Cover))
+}
+
+// WriteTags replaces tags of an mp3 or m4a file, the file is rewritten through
+// a temp file and tags are read back to make sure they took
+func WriteTags(path string, t Tags) error {
+	var err error
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".mp3":
+		err = rewrite(path, func(src *os.File, dst io.Writer) error { return writeID3(src, dst, t) })
+	case ".m4a", ".mp4", ".m4b":
+		err = rewrite(path, func(src *os.File, dst io.Writer) error { return writeMP4Tags(src, dst, t) })
+	default:
+		return fmt.Errorf("don't know how to tag %s", path)
+	}
+	if err != nil {
+		return err
+	}
+	got, err := ReadTags(path)
+	if err != nil {
+		return fmt.Errorf("reading back tags of %s: %v", path, err)
+	}
+	if got.Title != t.Title || got.Album != t.Album || got.Track != t.Track || len(got.Cover) != len(t.Cover) {
+		return fmt.Errorf("tags read back from %s don't match what was written", path)
+	}
+	return nil
+}
+
+// ReadTags reads tags of an mp3 or m4a file
+func ReadTags(path string) (Tags, error) {
+	fp, err := os.Open(path)
+	if err != nil {
+		return Tags{}, err
+	}
+	defer fp.Close()
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".mp3":
+		return readID3(fp)
+	case ".m4a", ".mp4", ".m4b":
+		return readMP4Tags(fp)
+	}
+	return Tags{}, fmt.Errorf("don't know how to read tags of %s", path)
+}
+
+// rewrite writes path anew with write, replacing it only when write succeeds
+func rewrite(path string, write func(src *os.File, dst io.Writer) error) error {
+	src, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	tmp, err := ioutil.TempFile(filepath.Dir(path), ".tag-")
+	if err != nil {
+		return err
+	}
+	err = write(src, tmp)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	if fi, err := src.Stat(); err == nil {
+		os.Chmod(tmp.Name(), fi.Mode())
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+var htmlTagRe = regexp.MustCompile(`<[^>]*>`)
+
+// plainText strips html of provider descriptions
+func plainText(s string) string {
+	return strings.TrimSpace(html.UnescapeString(htmlTagRe.ReplaceAllString(s, "")))
+}
+
+// itemTags are tags of item of podcast meta, cover is fetched by fetchCover
+func itemTags(meta PodcastMeta, item PodcastItem) Tags {
+	album := item.AlbumName
+	if album == "" {
+		album = meta.Title
+	}
+	track := item.Episode
+	if track == 0 {
+		track = item.Index
+	}
+	return Tags{
+		Title:       item.Title,
+		Album:       album,
+		Artist:      meta.IAuthor,
+		Date:        item.PubDate,
+		Track:       track,
+		Description: plainText(item.Description),
+	}
+}
+
+// maxCoverSize is what we are willing to embed
+const maxCoverSize = 5 << 20
+
+// fetchCover downloads cover art, item image first then podcast cover
+func fetchCover(urls []string, id *httpIdentity, source string) ([]byte, string, error) {
+	var lastErr error
+	for _, url := range urls {
+		if url == "" || url == "http:" {
+			continue
+		}
+		req, err := id.mediaRequest(context.Background(), "GET", url, source)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		resp, err := id.mediaClient().Do(req)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		data, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxCoverSize+1))
+		resp.Body.Close()
+		if err != nil || resp.StatusCode != http.StatusOK || len(data) > maxCoverSize {
+			lastErr = fmt.Errorf("cover %s: status %d, %d bytes, %v", url, resp.StatusCode, len(data), err)
+			continue
+		}
+		mime := http.DetectContentType(data)
+		if mime != "image/jpeg" && mime != "image/png" {
+			lastErr = fmt.Errorf("cover %s is %s", url, mime)
+			continue
+		}
+		return data, mime, nil
+	}
+	return nil, "", lastErr
+}
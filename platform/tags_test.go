@@ -0,0 +1,179 @@
+package platform
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf16"
+)
+
+var testTags = Tags{
+	Title:       "第12期：深夜电台 · 特别篇",
+	Album:       "深夜电台",
+	Artist:      "主播丙",
+	Date:        time.Date(2019, 3, 4, 0, 0, 0, 0, time.UTC),
+	Track:       12,
+	Description: "这一期聊聊「城市」与夜晚。\n第二行",
+	Cover:       []byte("\xff\xd8\xff\xe0\x00\x10JFIF\x00fake cover"),
+	CoverMime:   "image/jpeg",
+}
+
+func sameTags(t *testing.T, got, want Tags) {
+	t.Helper()
+	if !got.Date.Equal(want.Date) {
+		t.Errorf("date %v, want %v", got.Date, want.Date)
+	}
+	got.Date, want.Date = time.Time{}, time.Time{}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("tags read back:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+// id3v23Frame has a plain big endian size, unlike v2.4
+func id3v23Frame(id string, data []byte) []byte {
+	frame := make([]byte, 10, 10+len(data))
+	copy(frame, id)
+	binary.BigEndian.PutUint32(frame[4:], uint32(len(data)))
+	return append(frame, data...)
+}
+
+func utf16Text(s string) []byte {
+	b := []byte{id3UTF16, 0xff, 0xfe}
+	for _, u := range utf16.Encode([]rune(s)) {
+		b = append(b, byte(u), byte(u>>8))
+	}
+	return b
+}
+
+func TestWriteTagsMP3(t *testing.T) {
+	// v2.3 tag as other taggers write it, utf-16 text and a frame over 127 bytes
+	var frames bytes.Buffer
+	frames.Write(id3v23Frame("TIT2", utf16Text("旧标题")))
+	frames.Write(id3v23Frame("TPE1", append([]byte{id3Latin1}, "Old Artist"...)))
+	comm := append([]byte{id3Latin1}, "eng\x00"...)
+	frames.Write(id3v23Frame("COMM", append(comm, strings.Repeat("old comment ", 20)...)))
+	old := append([]byte{'I', 'D', '3', 3, 0, 0}, syncsafe(frames.Len())...)
+	old = append(old, frames.Bytes()...)
+	audio := []byte("\xff\xfb\x90\x64" + strings.Repeat("frame;", 500))
+	v1 := append([]byte("TAG"), make([]byte, 125)...)
+
+	path := filepath.Join(t.TempDir(), "episode.mp3")
+	if err := ioutil.WriteFile(path, append(append(old, audio...), v1...), 0644); err != nil {
+		t.Fatal(err)
+	}
+	before, err := ReadTags(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if before.Title != "旧标题" || before.Artist != "Old Artist" || !strings.HasPrefix(before.Description, "old comment") {
+		t.Errorf("v2.3 tag isn't read: %s", before)
+	}
+
+	if err := WriteTags(path, testTags); err != nil {
+		t.Fatal(err)
+	}
+	got, err := ReadTags(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sameTags(t, got, testTags)
+	data, _ := ioutil.ReadFile(path)
+	if data[3] != 4 {
+		t.Errorf("tag is v2.%d, want v2.4", data[3])
+	}
+	// old tags are dropped, audio is kept as it was
+	if !bytes.HasSuffix(data, audio) || bytes.Count(data, []byte("ID3")) != 1 {
+		t.Error("audio isn't kept as it was behind a single tag")
+	}
+}
+
+// testMP4 is ftyp, moov and mdat, or mdat before moov when mdatFirst. The
+// stco of one track and co64 of another point to chunks in mdat
+func testMP4(mdatFirst bool, chunks ...string) []byte {
+	ftyp := makeBox("ftyp", []byte("M4A \x00\x00\x00\x00M4A isom"))
+	mdat := makeBox("mdat", []byte(strings.Join(chunks, "")))
+	moovOf := func(mdatAt int) []byte {
+		stco := make([]byte, 12)
+		binary.BigEndian.PutUint32(stco[4:], 1)
+		binary.BigEndian.PutUint32(stco[8:], uint32(mdatAt+8))
+		co64 := make([]byte, 16)
+		binary.BigEndian.PutUint32(co64[4:], 1)
+		binary.BigEndian.PutUint64(co64[8:], uint64(mdatAt+8+len(chunks[0])))
+		trak := func(offsets []byte) []byte {
+			return makeBox("trak", makeBox("mdia", makeBox("minf", makeBox("stbl", offsets))))
+		}
+		return makeBox("moov", trak(makeBox("stco", stco)), trak(makeBox("co64", co64)))
+	}
+	if mdatFirst {
+		moov := moovOf(len(ftyp))
+		return append(append(ftyp, mdat...), moov...)
+	}
+	// offsets don't change the size of moov
+	moov := moovOf(len(ftyp) + len(moovOf(0)))
+	return append(append(ftyp, moov...), mdat...)
+}
+
+// chunkOffsets lists stco and co64 entries of every track in data
+func chunkOffsets(t *testing.T, data []byte) []int64 {
+	t.Helper()
+	r := bytes.NewReader(data)
+	var offsets []int64
+	var walk func(start, end int64)
+	walk = func(start, end int64) {
+		boxes, err := mp4Boxes(r, start, end)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, b := range boxes {
+			body := data[b.offset+b.header : b.offset+b.size]
+			switch b.typ {
+			case "moov", "trak", "mdia", "minf", "stbl":
+				walk(b.offset+b.header, b.offset+b.size)
+			case "stco":
+				offsets = append(offsets, int64(binary.BigEndian.Uint32(body[8:])))
+			case "co64":
+				offsets = append(offsets, int64(binary.BigEndian.Uint64(body[8:])))
+			}
+		}
+	}
+	walk(0, int64(len(data)))
+	return offsets
+}
+
+func TestWriteTagsMP4(t *testing.T) {
+	chunks := []string{"first chunk;", "second chunk;"}
+	for _, mdatFirst := range []bool{false, true} {
+		path := filepath.Join(t.TempDir(), "episode.m4a")
+		if err := ioutil.WriteFile(path, testMP4(mdatFirst, chunks...), 0644); err != nil {
+			t.Fatal(err)
+		}
+		// twice, the second write replaces metadata of the first
+		for i := 0; i < 2; i++ {
+			if err := WriteTags(path, testTags); err != nil {
+				t.Fatal(err)
+			}
+		}
+		got, err := ReadTags(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sameTags(t, got, testTags)
+
+		data, _ := ioutil.ReadFile(path)
+		offsets := chunkOffsets(t, data)
+		if len(offsets) != 2 {
+			t.Fatalf("mdat first %v: %d chunk offset tables, want 2", mdatFirst, len(offsets))
+		}
+		// offsets moved with mdat still point at the chunks
+		for n, off := range offsets {
+			if end := off + int64(len(chunks[n])); end > int64(len(data)) || string(data[off:end]) != chunks[n] {
+				t.Errorf("mdat first %v: chunk %d offset %d doesn't point at it", mdatFirst, n, off)
+			}
+		}
+	}
+}
@@ -1,8 +1,10 @@
 package platform
 
 import (
+	"errors"
 	"fmt"
 	"os"
+	"sort"
 	"strings"
 
 	"github.com/eduncan911/podcast"
@@ -16,6 +18,9 @@ func extractIDFromURL(url string) string {
 }
 
 func getMediaType(url string, log *zap.SugaredLogger) podcast.EnclosureType {
+	if strings.Contains(url, "?") {
+		url = url[:strings.Index(url, "?")]
+	}
 	if strings.HasSuffix(url, "m4a") {
 		return podcast.M4A
 	} else if strings.HasSuffix(url, "mp3") {
@@ -31,10 +36,96 @@ func getMediaType(url string, log *zap.SugaredLogger) podcast.EnclosureType {
 	return podcast.M4A
 }
 
-// ProduceRSSFeed is
-func ProduceRSSFeed(pid string, db *DB, log *zap.SugaredLogger) {
+// sortItems puts serial albums in listening order, others newest first
+func sortItems(items []PodcastItem, serial bool) {
+	sort.SliceStable(items, func(i, j int) bool {
+		if serial {
+			return items[i].Index < items[j].Index
+		}
+		return items[i].PubDate.After(items[j].PubDate)
+	})
+}
+
+// enclosureType prefers the probed mime type, falls back to guess from url
+func enclosureType(item PodcastItem, log *zap.SugaredLogger) podcast.EnclosureType {
+	switch item.MimeType {
+	case "audio/mpeg", "audio/mp3":
+		return podcast.MP3
+	case "audio/x-m4a", "audio/mp4", "audio/m4a", "audio/aac":
+		return podcast.M4A
+	case "video/mp4":
+		return podcast.MP4
+	}
+	return getMediaType(item.Src, log)
+}
+
+// ProduceRSSFeed is, split, composite and inbox feeds having podcast pid are
+// produced too
+func ProduceRSSFeed(pid string, db *DB, cfg *Config, log *zap.SugaredLogger) {
 	meta, _ := db.FindPodcastMeta(pid)
 	items, _ := db.FindPodcastItems(pid)
+	writeFeed(pid, feedSource{meta: meta, items: items}, db, cfg, log)
+	for _, id := range cfg.splitsOf(pid) {
+		if err := ProduceSplitFeed(id, db, cfg, log); err != nil {
+			log.Warnw("split feed failed", "id", id, "error", err)
+		}
+	}
+	for _, id := range cfg.compositesOf(pid) {
+		err := ProduceCompositeFeed(id, db, cfg, log)
+		if errors.Is(err, ErrNotFound) {
+			log.Infow("composite feed waits for its podcasts to be fetched", "id", id, "error", err)
+		} else if err != nil {
+			log.Warnw("composite feed failed", "id", id, "error", err)
+		}
+	}
+	for _, id := range cfg.inboxesOf(pid) {
+		if err := ProduceInboxFeed(id, db, cfg, log); err != nil {
+			log.Warnw("inbox feed failed", "id", id, "error", err)
+		}
+	}
+}
+
+// feedSource is what a feed is made of
+type feedSource struct {
+	meta  PodcastMeta
+	items []PodcastItem
+	guid  string            // podcast:guid, made of link of meta when empty
+	guids map[string]string // guids of items by id, made of item when missing
+}
+
+// writeFeed generates feed pid of src
+func writeFeed(pid string, src feedSource, db *DB, cfg *Config, log *zap.SugaredLogger) {
+	ch := buildFeed(pid, src, db, cfg, log)
+	fp, _ := os.OpenFile(cfg.FeedPath(pid), os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0755)
+	defer fp.Close()
+	if err := ch.encode(fp); err != nil {
+		fmt.Println("error writing to stdout:", err.Error())
+	}
+}
+
+// buildFeed is the channel of feed pid made of src
+func buildFeed(pid string, src feedSource, db *DB, cfg *Config, log *zap.SugaredLogger) *rssChannel {
+	meta, items := src.meta, src.items
+	fc := cfg.Feed(pid)
+	// guid and serial of podcast stay what provider says
+	meta = overrideMeta(meta, fc)
+	sortItems(items, fc.Type == "serial" || (fc.Type == "" && meta.Serial))
+	// filters see titles as provider gives them, before rewrites and paid markers
+	kept, err := filterItems(items, fc)
+	if err != nil {
+		log.Warnw("feed filters are broken, every item is kept", "id", pid, "error", err)
+	} else if len(kept) != len(items) {
+		log.Infow("items filtered out of feed", "id", pid, "count", len(items)-len(kept))
+	}
+	items = kept
+	if items, err = overrideItems(items, fc); err != nil {
+		log.Warnw("title rewrites are broken, titles are kept", "id", pid, "error", err)
+	}
+	kept = applyPaidPolicy(items, fc.Paid)
+	if len(kept) != len(items) {
+		log.Infow("paid items left out of feed", "id", pid, "count", len(items)-len(kept), "policy", fc.Paid)
+	}
+	items = kept
 
 	pd := podcast.New(
 		meta.Title,
@@ -44,9 +135,31 @@ func ProduceRSSFeed(pid string, db *DB, log *zap.SugaredLogger) {
 		&meta.LastBuildDate,
 	)
 	if len(meta.Category) != 0 {
-		pd.AddCategory(meta.Category[0], []string{})
+		var subs []string
+		if fc.Category != "" {
+			// provider categories have no itunes subcategories
+			subs = meta.Category[1:]
+		}
+		pd.AddCategory(meta.Category[0], subs)
 	}
 	pd.AddImage(meta.CoverImgURL)
+	pd.AddSummary(meta.ISummary)
+	pd.IAuthor = meta.IAuthor
+	if fc.Language != "" {
+		pd.Language = fc.Language
+	}
+	if fc.Owner.Name != "" || fc.Owner.Email != "" {
+		pd.IOwner = &podcast.Author{Name: fc.Owner.Name, Email: fc.Owner.Email}
+	}
+	pd.IExplicit = "false"
+	if fc.Explicit != nil && *fc.Explicit {
+		pd.IExplicit = "true"
+	}
+	ch := newRSSChannel(&pd, meta, fc, cfg.FeedURL(pid))
+	if src.guid != "" {
+		ch.GUID = src.guid
+	}
+	ch.guids = src.guids
 
 	for _, item := range items {
 		i := podcast.Item{
@@ -57,17 +170,45 @@ func ProduceRSSFeed(pid string, db *DB, log *zap.SugaredLogger) {
 		}
 		i.AddImage(item.ImageURL)
 		i.AddDuration(int64(item.Duration))
-		i.AddEnclosure(item.Src, getMediaType(item.Src, log), 0)
 
-		_, err := pd.AddItem(i)
-		if err != nil {
-			log.Error(err)
+		enc := chooseVariant(item, fc.Quality)
+		var alternates []rssAlternateEnclosure
+		if fc.AlternateEnclosures {
+			for _, v := range item.Variants {
+				if v.URL == enc.URL {
+					continue
+				}
+				length, mime := variantMedia(item, v, db)
+				alternates = append(alternates, rssAlternateEnclosure{
+					Type:    mime,
+					Length:  length,
+					Bitrate: v.Bitrate,
+					Title:   strings.TrimSpace(v.Format + " " + v.Quality),
+					Source:  rssSource{URI: v.URL},
+				})
+			}
+		}
+		item.Length, item.MimeType = variantMedia(item, enc, db)
+		item.Src = enc.URL
+		local := false
+		if fc.LocalEnclosures {
+			if url, length, mime, ok := localEnclosure(item, cfg); ok {
+				item.Src, item.Length, item.MimeType = url, length, mime
+				local = true
+			}
+		}
+		if fc.ProxyEnclosures && !local && item.Src != "" {
+			if url := cfg.ProxyURL(item, enc); url != "" {
+				item.Src = url
+			}
+		}
+		if item.Src != "" {
+			i.AddEnclosure(item.Src, enclosureType(item, log), item.Length)
 		}
-	}
 
-	fp, _ := os.OpenFile(fmt.Sprintf("%s.xml", meta.ID), os.O_RDWR|os.O_CREATE, 0755)
-	defer fp.Close()
-	if err := pd.Encode(fp); err != nil {
-		fmt.Println("error writing to stdout:", err.Error())
+		if err := ch.addItem(i, item, alternates); err != nil {
+			log.Error(err)
+		}
 	}
+	return ch
 }
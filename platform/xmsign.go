@@ -0,0 +1,82 @@
+package platform
+
+import (
+	"crypto/md5"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/levigross/grequests"
+)
+
+// xmSigner adds the xm-sign header required by ximalaya revision api,
+// the sign is derived from ximalaya server time so we fetch it once and keep the offset
+type xmSigner struct {
+	timeURL string
+	client  *http.Client
+	now     func() time.Time
+	random  func(n int) int
+
+	mu     sync.Mutex
+	offset time.Duration
+	synced bool
+
+	identity *httpIdentity
+}
+
+func newXMSigner(timeURL string, client *http.Client) *xmSigner {
+	return &xmSigner{
+		timeURL: timeURL,
+		client:  client,
+		now:     time.Now,
+		random:  rand.Intn,
+	}
+}
+
+// xmSign is md5("himalaya-"+serverTime)(r1)serverTime(r2)localTime, times are unix ms
+func xmSign(serverTime, localTime int64, r1, r2 int) string {
+	sum := md5.Sum([]byte(fmt.Sprintf("himalaya-%d", serverTime)))
+	return fmt.Sprintf("%x(%d)%d(%d)%d", sum, r1, serverTime, r2, localTime)
+}
+
+func unixMilli(t time.Time) int64 {
+	return t.UnixNano() / int64(time.Millisecond)
+}
+
+func (s *xmSigner) serverTime() (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.synced {
+		reqOpt := requestOptions(himalayaDomain)
+		reqOpt.HTTPClient = s.client
+		s.identity.apply(reqOpt)
+		resp, err := grequests.Get(s.timeURL, reqOpt)
+		if err != nil {
+			return 0, err
+		}
+		if resp.StatusCode != 200 {
+			return 0, fmt.Errorf("fetch ximalaya server time: status %d", resp.StatusCode)
+		}
+		ms, err := strconv.ParseInt(strings.TrimSpace(resp.String()), 10, 64)
+		if err != nil {
+			return 0, err
+		}
+		s.offset = time.Duration(ms-unixMilli(s.now())) * time.Millisecond
+		s.synced = true
+	}
+	return unixMilli(s.now().Add(s.offset)), nil
+}
+
+// sign is used as grequests.RequestOptions.BeforeRequest
+func (s *xmSigner) sign(req *http.Request) error {
+	st, err := s.serverTime()
+	if err != nil {
+		return err
+	}
+	req.Header.Set("xm-sign", xmSign(st, unixMilli(s.now()), s.random(100), s.random(100)))
+	return nil
+}
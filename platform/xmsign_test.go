@@ -0,0 +1,65 @@
+package platform
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/dracher/podcast_fetcher/fakeprovider"
+	"github.com/levigross/grequests"
+)
+
+func TestXMSign(t *testing.T) {
+	cases := []struct {
+		serverTime, localTime int64
+		r1, r2                int
+		want                  string
+	}{
+		{1545123456789, 1545123450000, 42, 7, "dce76f0ede58547dbf68a4a41329d128(42)1545123456789(7)1545123450000"},
+		{1700000000000, 1700000000123, 99, 1, "3e50dff13024bbeea72b6790982221b3(99)1700000000000(1)1700000000123"},
+		{0, 0, 0, 0, "24393343084be486d4ce4228bc83f4a8(0)0(0)0"},
+	}
+	for _, c := range cases {
+		if got := xmSign(c.serverTime, c.localTime, c.r1, c.r2); got != c.want {
+			t.Errorf("xmSign(%d, %d, %d, %d) = %s, want %s", c.serverTime, c.localTime, c.r1, c.r2, got, c.want)
+		}
+	}
+}
+
+func TestXMSignerAgainstFakeProvider(t *testing.T) {
+	srv := httptest.NewServer(fakeprovider.New(fakeprovider.Options{RequireSign: true}))
+	defer srv.Close()
+	client := &http.Client{Transport: fakeprovider.Redirect{Base: srv.URL}}
+	signer := newXMSigner(himalayaServerTimeQuery, client)
+	// a local clock far off server time, the offset must make up for it
+	signer.now = func() time.Time { return time.Unix(1000, 0) }
+	signer.random = func(n int) int { return n - 1 }
+
+	ret := func(sign bool) int {
+		reqOpt := requestOptions(himalayaDomain)
+		reqOpt.HTTPClient = client
+		if sign {
+			reqOpt.BeforeRequest = signer.sign
+		}
+		resp, err := grequests.Get(fmt.Sprintf(himalayaPodcastMetaQuery, "1000"), reqOpt)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var body struct{ Ret int }
+		if err := resp.JSON(&body); err != nil {
+			t.Fatal(err)
+		}
+		return body.Ret
+	}
+	if got := ret(false); got != 403 {
+		t.Errorf("unsigned request got ret %d, want 403", got)
+	}
+	if got := ret(true); got != himalayaRetOK {
+		t.Errorf("signed request got ret %d, want %d", got, himalayaRetOK)
+	}
+	if !signer.synced || signer.offset < 24*time.Hour {
+		t.Errorf("signer didn't sync with server time, offset %v", signer.offset)
+	}
+}